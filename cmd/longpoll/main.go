@@ -1,26 +1,67 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/asahnoln/mesproc/internal/config"
+	"github.com/asahnoln/mesproc/pkg/tg"
 )
 
-// Testing purposes only
+// pollTimeout is how long Telegram holds each getUpdates request waiting for updates
+const pollTimeout = 30 * time.Second
+
+// Long polling runner for rehearsals: it needs neither TLS certificates nor a public address.
+// The bot should not have a webhook set, otherwise Telegram refuses to give updates.
 func main() {
-	resp, err := http.Get(os.Getenv("BOT_ADDR") + "/getUpdates")
+	str, err := config.Story()
+	if err != nil {
+		log.Fatalf("error creating dependencies: %v", err)
+	}
+
+	sched, err := config.Scheduler()
+	if err != nil {
+		log.Fatalf("error creating dependencies: %v", err)
+	}
+	sess, err := config.SessionStore()
 	if err != nil {
-		log.Fatalf("unexpected error while getting updates: %v", err)
+		log.Fatalf("error creating dependencies: %v", err)
+	}
+	if c, ok := sess.(io.Closer); ok {
+		defer c.Close()
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	defer resp.Body.Close()
+	files, err := config.FileCache()
+	if err != nil {
+		log.Fatalf("error creating dependencies: %v", err)
+	}
 
+	limiter, err := config.Limiter()
 	if err != nil {
-		log.Fatalf("unexpected error while reading response: %v", err)
+		log.Fatalf("error creating dependencies: %v", err)
 	}
 
-	fmt.Print(string(body))
+	logger := log.New(os.Stderr, "", 0)
+	config.ServeMetrics(limiter, logger)
+
+	// Local media of the story are relative to MEDIA_DIR
+	th := tg.New(os.Getenv("BOT_ADDR"), str, logger,
+		tg.WithScheduler(sched), tg.WithSessionStore(sess),
+		tg.WithFileCache(files), tg.WithMediaDir(os.Getenv("MEDIA_DIR")),
+		tg.WithLimiter(limiter))
+	p := tg.NewPoller(th, pollTimeout, logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Println("polling updates")
+	if err := p.Run(ctx); err != nil {
+		logger.Fatalf("polling error: %v", err)
+	}
+	logger.Printf("stopped at update offset %d", p.Offset())
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/asahnoln/mesproc/pkg/session"
+)
+
+// Prints progress of every user kept by the webhook or the long polling runner
+func main() {
+	dir := flag.String("dir", os.Getenv("SESSION_DIR"), "directory with session files")
+	db := flag.String("db", os.Getenv("SESSION_DB"), "path to session database")
+	flag.Parse()
+
+	var s session.Store
+	switch {
+	case *db != "":
+		b, err := session.NewBolt(*db)
+		if err != nil {
+			log.Fatalf("error opening sessions: %v", err)
+		}
+		defer b.Close()
+		s = b
+	case *dir != "":
+		s = session.NewFile(*dir)
+	default:
+		log.Fatal("either -dir or -db should be set")
+	}
+
+	ss, err := s.List()
+	if err != nil {
+		log.Fatalf("error listing sessions: %v", err)
+	}
+
+	ids := make([]int, 0, len(ss))
+	for id := range ss {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHAT\tSTEP\tLANG\tFAILS\tACTIVE\tVARS")
+	for _, id := range ids {
+		sess := ss[id]
+		fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%t\t%s\n", id, sess.Step, sess.Lang, sess.Fails, !sess.Inactive, formatVars(sess))
+	}
+	w.Flush()
+}
+
+func formatVars(s session.Session) string {
+	vs := make([]string, 0, len(s.Vars))
+	for k, v := range s.Vars {
+		vs = append(vs, fmt.Sprintf("%s=%d", k, v))
+	}
+	sort.Strings(vs)
+	return strings.Join(vs, " ")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+)
+
+func main() {
+	storyPath := flag.String("story", os.Getenv("STORY_PATH"), "path to story JSON or YAML file")
+	format := flag.String("format", "dot", "diagram format: dot or mermaid")
+	flag.Parse()
+
+	str, err := story.LoadFile(*storyPath)
+	if err != nil {
+		log.Fatalf("error loading %s: %v", *storyPath, err)
+	}
+
+	switch *format {
+	case "dot":
+		err = str.WriteDOT(os.Stdout)
+	case "mermaid":
+		err = str.WriteMermaid(os.Stdout)
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+
+	if err != nil {
+		log.Fatalf("error writing diagram: %v", err)
+	}
+}
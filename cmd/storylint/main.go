@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+)
+
+func main() {
+	storyPath := flag.String("story", os.Getenv("STORY_PATH"), "path to story JSON or YAML file")
+	i18nPath := flag.String("i18n", os.Getenv("I18N_PATH"), "path to i18n JSON file, optional")
+	flag.Parse()
+
+	sFile, err := os.Open(*storyPath)
+	if err != nil {
+		log.Fatalf("error opening story file: %v", err)
+	}
+	defer sFile.Close()
+
+	// YAML stories are validated as JSON, problems point to steps anyway
+	var str io.Reader = sFile
+	if story.IsYAML(*storyPath) {
+		b := &bytes.Buffer{}
+		if err := story.YAMLToJSON(b, sFile); err != nil {
+			log.Fatalf("error converting %s: %v", *storyPath, err)
+		}
+		str = b
+	}
+
+	var iFile io.Reader
+	if *i18nPath != "" {
+		f, err := os.Open(*i18nPath)
+		if err != nil {
+			log.Fatalf("error opening i18n file: %v", err)
+		}
+		defer f.Close()
+		iFile = f
+	}
+
+	ps, err := story.Validate(str, iFile)
+	if err != nil {
+		log.Fatalf("error validating %s: %v", *storyPath, err)
+	}
+
+	for _, p := range ps {
+		fmt.Println(p)
+	}
+
+	if len(ps) > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,51 +1,82 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/asahnoln/mesproc/internal/config"
 	"github.com/asahnoln/mesproc/pkg/story"
 	"github.com/asahnoln/mesproc/pkg/tg"
 )
 
-func loadStory() (*story.Story, error) {
-	sFile, err := os.Open(os.Getenv("STORY_PATH"))
-	if err != nil {
-		return nil, fmt.Errorf("error opening story file: %w", err)
-	}
+// shutdownTimeout is how long updates being processed are waited for on shutdown
+const shutdownTimeout = 30 * time.Second
 
-	iFile, err := os.Open(os.Getenv("I18N_PATH"))
+func createLogger() (*log.Logger, error) {
+	f, err := os.OpenFile(os.Getenv("LOG_PATH"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		return nil, fmt.Errorf("error opening i18n file: %w", err)
+		return nil, fmt.Errorf("error opening log file: %w", err)
 	}
 
-	str, err := story.Load(sFile)
-	if err != nil {
-		return nil, fmt.Errorf("error loading story: %w", err)
-	}
+	logger := log.New(f, "", 0)
+	return logger, nil
+}
 
-	i18n, err := story.LoadI18n(iFile)
-	if err != nil {
-		return nil, fmt.Errorf("error loading i18n: %w", err)
+// webhookSecret returns WEBHOOK_SECRET. If it is not set, but the webhook is set up on startup,
+// a random secret is made for this run.
+// Without both anyone knowing the address can post forged updates,
+// so the webhook runs without a secret only if WEBHOOK_INSECURE is set.
+func webhookSecret() (string, error) {
+	if s := os.Getenv("WEBHOOK_SECRET"); s != "" {
+		return s, nil
+	}
+	if os.Getenv("WEBHOOK_URL") == "" {
+		if insecure, _ := strconv.ParseBool(os.Getenv("WEBHOOK_INSECURE")); insecure {
+			return "", nil
+		}
+		return "", errors.New("WEBHOOK_SECRET or WEBHOOK_URL should be set to reject forged updates, set WEBHOOK_INSECURE=true to accept any")
 	}
 
-	return str.I18n(i18n), nil
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error making webhook secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
 }
 
-func createLogger() (*log.Logger, error) {
-	f, err := os.OpenFile(os.Getenv("LOG_PATH"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("error opening log file: %w", err)
+// setupWebhook makes Telegram send updates to WEBHOOK_URL with the secret token, if the URL is set.
+// WEBHOOK_CERT is the public key of a self-signed certificate to upload.
+func setupWebhook(ctx context.Context, c *tg.Client, secret string) error {
+	url := os.Getenv("WEBHOOK_URL")
+	if url == "" {
+		return nil
 	}
 
-	logger := log.New(f, "", 0)
-	return logger, nil
+	err := c.SetWebhook(ctx, tg.SetWebhook{
+		URL:            url,
+		Certificate:    os.Getenv("WEBHOOK_CERT"),
+		SecretToken:    secret,
+		AllowedUpdates: tg.AllowedUpdates,
+	})
+	if err != nil {
+		return fmt.Errorf("error setting webhook %s: %w", url, err)
+	}
+	return nil
 }
 
 func dependendcies() (*story.Story, *log.Logger, error) {
-	str, err := loadStory()
+	str, err := config.Story()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -63,13 +94,89 @@ func main() {
 	if err != nil {
 		log.Fatalf("error creating dependencies: %v", err)
 	}
-	th := tg.New(os.Getenv("BOT_ADDR"), str, logger)
+	sched, err := config.Scheduler()
+	if err != nil {
+		log.Fatalf("error creating dependencies: %v", err)
+	}
+	sess, err := config.SessionStore()
+	if err != nil {
+		log.Fatalf("error creating dependencies: %v", err)
+	}
+	files, err := config.FileCache()
+	if err != nil {
+		log.Fatalf("error creating dependencies: %v", err)
+	}
+	limiter, err := config.Limiter()
+	if err != nil {
+		log.Fatalf("error creating dependencies: %v", err)
+	}
+	config.ServeMetrics(limiter, logger)
+
+	secret, err := webhookSecret()
+	if err != nil {
+		log.Fatalf("error creating dependencies: %v", err)
+	}
+	if secret == "" {
+		const warning = "WARNING: the webhook has no secret token, updates are accepted from anyone"
+		log.Println(warning)
+		logger.Println(warning)
+	}
+
+	client := tg.NewClient(os.Getenv("BOT_ADDR"))
+	client.Logger = logger
+
+	// Local media of the story are relative to MEDIA_DIR
+	opts := []tg.Option{
+		tg.WithClient(client), tg.WithSecretToken(secret),
+		tg.WithScheduler(sched), tg.WithSessionStore(sess),
+		tg.WithFileCache(files), tg.WithMediaDir(os.Getenv("MEDIA_DIR")),
+		tg.WithLimiter(limiter),
+	}
+	// WEBHOOK_REPLY answers the webhook with the response, saving a call to Telegram
+	if reply, _ := strconv.ParseBool(os.Getenv("WEBHOOK_REPLY")); reply {
+		opts = append(opts, tg.WithWebhookReply())
+	}
+	th := tg.New(os.Getenv("BOT_ADDR"), str, logger, opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := setupWebhook(ctx, client, secret); err != nil {
+		logger.Fatalln(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(os.Getenv("SRV_BOT_PATH"), th)
+	srv := &http.Server{Addr: os.Getenv("SRV_PORT"), Handler: mux}
 
-	logger.Fatalln(http.ListenAndServeTLS(
-		os.Getenv("SRV_PORT"), os.Getenv("CERT_FILE"), os.Getenv("KEY_FILE"),
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			mux := http.NewServeMux()
-			mux.Handle(os.Getenv("SRV_BOT_PATH"), th)
-			mux.ServeHTTP(w, r)
-		})))
+	// Updates being processed are finished before the server stops
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			logger.Printf("shutdown error: %v", err)
+		}
+		// Acknowledged updates are still processed after their requests are answered
+		th.Wait()
+	}()
+
+	err = srv.ListenAndServeTLS(os.Getenv("CERT_FILE"), os.Getenv("KEY_FILE"))
+	if !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatalln(err)
+	}
+	<-stopped
+
+	// WEBHOOK_DELETE deletes the webhook on shutdown, so the bot can be run by long polling afterwards
+	if del, _ := strconv.ParseBool(os.Getenv("WEBHOOK_DELETE")); del {
+		if err := client.DeleteWebhook(context.Background(), false); err != nil {
+			logger.Printf("error deleting webhook: %v", err)
+		}
+	}
+	if c, ok := sess.(io.Closer); ok {
+		c.Close()
+	}
 }
@@ -0,0 +1,137 @@
+// Package config creates dependencies of the bot from environment variables,
+// so the webhook and the long polling runners are configured the same way.
+package config
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/session"
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/asahnoln/mesproc/pkg/tg"
+)
+
+// Story loads the story from STORY_PATH, YAML or JSON, and its i18n from I18N_PATH.
+// STORY_TOLERANCE overrides the tolerance set in the story file.
+func Story() (*story.Story, error) {
+	str, err := story.LoadFile(os.Getenv("STORY_PATH"))
+	if err != nil {
+		return nil, fmt.Errorf("error loading story %s: %w", os.Getenv("STORY_PATH"), err)
+	}
+
+	iFile, err := os.Open(os.Getenv("I18N_PATH"))
+	if err != nil {
+		return nil, fmt.Errorf("error opening i18n file: %w", err)
+	}
+	defer iFile.Close()
+
+	i18n, err := story.LoadI18n(iFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading i18n %s: %w", iFile.Name(), err)
+	}
+
+	if t := os.Getenv("STORY_TOLERANCE"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing story tolerance: %w", err)
+		}
+		str.Tolerate(n)
+	}
+
+	return str.I18n(i18n), nil
+}
+
+// SessionStore keeps progress of users in SESSION_DB database or in SESSION_DIR directory,
+// so they continue where they were after restart. Without them progress is kept in memory.
+func SessionStore() (session.Store, error) {
+	if db := os.Getenv("SESSION_DB"); db != "" {
+		s, err := session.NewBolt(db)
+		if err != nil {
+			return nil, fmt.Errorf("error opening sessions: %w", err)
+		}
+		return s, nil
+	}
+
+	if dir := os.Getenv("SESSION_DIR"); dir != "" {
+		return session.NewFile(dir), nil
+	}
+
+	return session.NewMemory(), nil
+}
+
+// Scheduler keeps delayed responses in SCHEDULE_PATH file if it is set, so they survive restarts.
+// SCHEDULE_GRACE is how overdue a response can be to still be sent after restart, like "10m".
+func Scheduler() (tg.Scheduler, error) {
+	path := os.Getenv("SCHEDULE_PATH")
+	if path == "" {
+		return tg.NewMemoryScheduler(tg.RealClock), nil
+	}
+
+	var grace time.Duration
+	if g := os.Getenv("SCHEDULE_GRACE"); g != "" {
+		var err error
+		grace, err = time.ParseDuration(g)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing schedule grace: %w", err)
+		}
+	}
+
+	s, err := tg.NewFileScheduler(path, tg.RealClock, grace)
+	if err != nil {
+		return nil, fmt.Errorf("error loading schedule %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// FileCache keeps file_ids of uploaded local media in MEDIA_CACHE_PATH file if it is set,
+// so they are not uploaded again after restart
+func FileCache() (tg.FileCache, error) {
+	path := os.Getenv("MEDIA_CACHE_PATH")
+	if path == "" {
+		return tg.NewMemoryFileCache(), nil
+	}
+
+	c, err := tg.NewFileCache(path)
+	if err != nil {
+		return nil, fmt.Errorf("error loading media cache %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Limiter keeps outgoing messages within Telegram limits.
+// RATE_GLOBAL and RATE_CHAT change how many messages per second are sent to all chats and to each chat.
+func Limiter() (*tg.Limiter, error) {
+	global, chat := float64(tg.DefaultGlobalRate), float64(tg.DefaultChatRate)
+	for env, rate := range map[string]*float64{"RATE_GLOBAL": &global, "RATE_CHAT": &chat} {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("error parsing %s: %q is not a positive number", env, v)
+		}
+		*rate = r
+	}
+
+	return tg.NewLimiter(tg.RealClock, global, chat), nil
+}
+
+// ServeMetrics publishes the depth of the outgoing queue at /debug/vars of METRICS_ADDR if it is set
+func ServeMetrics(l *tg.Limiter, logger *log.Logger) {
+	expvar.Publish("queue_depth", expvar.Func(func() interface{} {
+		return l.Depth()
+	}))
+
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		go func() {
+			logger.Printf("metrics error: %v", http.ListenAndServe(addr, expvar.Handler()))
+		}()
+	}
+}
@@ -0,0 +1,29 @@
+package fsutil_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asahnoln/mesproc/internal/fsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+
+	require.NoError(t, fsutil.WriteFileAtomic(path, []byte("first")))
+	require.NoError(t, fsutil.WriteFileAtomic(path, []byte("second")))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(b), "want the file replaced")
+
+	es, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, es, 1, "want no temporary files left")
+
+	assert.Error(t, fsutil.WriteFileAtomic(filepath.Join(dir, "missing", "data.json"), nil), "want error without the directory")
+}
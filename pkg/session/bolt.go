@@ -0,0 +1,102 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// sessionsBucket is the bbolt bucket with sessions keyed by chat ID
+var sessionsBucket = []byte("sessions")
+
+// Bolt is a Store which keeps sessions in an embedded bbolt database file
+type Bolt struct {
+	db *bolt.DB
+}
+
+// NewBolt opens or creates the database at path.
+// The database is locked while it is open, so it should be closed with Close.
+func NewBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("session: open %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("session: open %s: %w", path, err)
+	}
+
+	return &Bolt{db}, nil
+}
+
+// Close closes the database
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// Load implements Store
+func (b *Bolt) Load(id int) (Session, error) {
+	var s Session
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(sessionsBucket).Get([]byte(strconv.Itoa(id)))
+		if v == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, &s)
+	})
+	if err != nil && err != ErrNotFound {
+		return s, fmt.Errorf("session: load: %w", err)
+	}
+
+	return s, err
+}
+
+// Save implements Store
+func (b *Bolt) Save(id int, s Session) error {
+	v, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("session: save: %w", err)
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(strconv.Itoa(id)), v)
+	})
+	if err != nil {
+		return fmt.Errorf("session: save: %w", err)
+	}
+
+	return nil
+}
+
+// List implements Store
+func (b *Bolt) List() (map[int]Session, error) {
+	ss := make(map[int]Session)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			id, err := strconv.Atoi(string(k))
+			if err != nil {
+				return nil
+			}
+
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil {
+				return fmt.Errorf("chat %d: %w", id, err)
+			}
+			ss[id] = s
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("session: list: %w", err)
+	}
+
+	return ss, nil
+}
@@ -0,0 +1,91 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/asahnoln/mesproc/internal/fsutil"
+)
+
+// File is a Store which keeps every session in its own JSON file in a directory
+type File struct {
+	dir string
+}
+
+// NewFile creates a File store in the directory, which should exist
+func NewFile(dir string) *File {
+	return &File{dir}
+}
+
+func (f *File) path(id int) string {
+	return filepath.Join(f.dir, strconv.Itoa(id)+".json")
+}
+
+// Load implements Store
+func (f *File) Load(id int) (Session, error) {
+	return f.read(f.path(id))
+}
+
+func (f *File) read(path string) (Session, error) {
+	var s Session
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, ErrNotFound
+	}
+	if err != nil {
+		return s, fmt.Errorf("session: load: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("session: load %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Save implements Store. The file is replaced at once, so a crash while saving does not leave a broken session.
+func (f *File) Save(id int, s Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("session: save: %w", err)
+	}
+
+	if err := fsutil.WriteFileAtomic(f.path(id), b); err != nil {
+		return fmt.Errorf("session: save: %w", err)
+	}
+
+	return nil
+}
+
+// List implements Store. Files which are not named by a chat ID are skipped.
+func (f *File) List() (map[int]Session, error) {
+	es, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, fmt.Errorf("session: list: %w", err)
+	}
+
+	ss := make(map[int]Session)
+	for _, e := range es {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+
+		s, err := f.read(filepath.Join(f.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		ss[id] = s
+	}
+
+	return ss, nil
+}
@@ -0,0 +1,47 @@
+package session
+
+import "sync"
+
+// Memory is a Store which keeps sessions in memory, they are lost on restart
+type Memory struct {
+	mu       sync.Mutex
+	sessions map[int]Session
+}
+
+// NewMemory creates a Memory store
+func NewMemory() *Memory {
+	return &Memory{sessions: make(map[int]Session)}
+}
+
+// Load implements Store
+func (m *Memory) Load(id int) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return s.clone(), nil
+}
+
+// Save implements Store
+func (m *Memory) Save(id int, s Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[id] = s.clone()
+	return nil
+}
+
+// List implements Store
+func (m *Memory) List() (map[int]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ss := make(map[int]Session, len(m.sessions))
+	for id, s := range m.sessions {
+		ss[id] = s.clone()
+	}
+	return ss, nil
+}
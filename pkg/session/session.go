@@ -0,0 +1,47 @@
+// Package session keeps progress of users going through a story, so it survives restarts.
+package session
+
+import (
+	"errors"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+)
+
+// ErrNotFound is returned when a chat has no session yet
+var ErrNotFound = errors.New("session not found")
+
+// Session is the progress of a user in the story
+type Session struct {
+	Step          int              `json:"step"`
+	Lang          string           `json:"lang,omitempty"`
+	Vars          story.Vars       `json:"vars,omitempty"`
+	Fails         int              `json:"fails,omitempty"`
+	LastResponses []story.Response `json:"lastResponses,omitempty"`
+	// Inactive is set when the bot cannot send to the user anymore, like when they blocked the bot
+	Inactive bool `json:"inactive,omitempty"`
+}
+
+// Store keeps sessions of chats
+type Store interface {
+	// Load returns the session of the chat or ErrNotFound if there is none
+	Load(id int) (Session, error)
+	// Save saves the session of the chat
+	Save(id int, s Session) error
+	// List returns sessions of all chats
+	List() (map[int]Session, error)
+}
+
+// clone copies the session, so changing one of them doesn't change another
+func (s Session) clone() Session {
+	if s.Vars != nil {
+		vars := make(story.Vars, len(s.Vars))
+		for k, v := range s.Vars {
+			vars[k] = v
+		}
+		s.Vars = vars
+	}
+	if s.LastResponses != nil {
+		s.LastResponses = append([]story.Response(nil), s.LastResponses...)
+	}
+	return s
+}
@@ -0,0 +1,106 @@
+package session_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asahnoln/mesproc/pkg/session"
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stores(t *testing.T) map[string]func() session.Store {
+	dir := t.TempDir()
+	db := filepath.Join(t.TempDir(), "sessions.db")
+
+	return map[string]func() session.Store{
+		"file": func() session.Store {
+			return session.NewFile(dir)
+		},
+		"bolt": func() session.Store {
+			b, err := session.NewBolt(db)
+			require.NoError(t, err)
+			t.Cleanup(func() { b.Close() })
+			return b
+		},
+	}
+}
+
+func TestStores(t *testing.T) {
+	str := story.New().Add(story.NewStep().Expect("go").Respond("went", "still going"))
+	rs := str.ResponsesTo(&story.State{Lang: "ru"}, "go")
+
+	for name, open := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open()
+
+			_, err := s.Load(1)
+			assert.ErrorIs(t, err, session.ErrNotFound)
+
+			want := session.Session{Step: 1, Lang: "ru", Vars: story.Vars{"score": 2}, Fails: 3, LastResponses: rs}
+			require.NoError(t, s.Save(1, want))
+			require.NoError(t, s.Save(2, session.Session{Step: 5, Inactive: true}))
+
+			got, err := s.Load(1)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+
+			all, err := s.List()
+			require.NoError(t, err)
+			assert.Equal(t, map[int]session.Session{1: want, 2: {Step: 5, Inactive: true}}, all)
+		})
+	}
+}
+
+func TestStoresSurviveReopening(t *testing.T) {
+	for name, open := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open()
+			require.NoError(t, s.Save(7, session.Session{Step: 3, Lang: "en"}))
+			if c, ok := s.(interface{ Close() error }); ok {
+				require.NoError(t, c.Close())
+			}
+
+			got, err := open().Load(7)
+			require.NoError(t, err)
+			assert.Equal(t, session.Session{Step: 3, Lang: "en"}, got)
+		})
+	}
+}
+
+func TestMemoryCopiesSessions(t *testing.T) {
+	s := session.NewMemory()
+	vars := story.Vars{"score": 1}
+	require.NoError(t, s.Save(1, session.Session{Vars: vars}))
+
+	vars["score"] = 2
+	got, err := s.Load(1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, got.Vars["score"], "want saved session not changed")
+
+	_, err = s.Load(2)
+	assert.ErrorIs(t, err, session.ErrNotFound)
+}
+
+func TestFileListSkipsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hi"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0644))
+
+	s := session.NewFile(dir)
+	require.NoError(t, s.Save(1, session.Session{Step: 2}))
+
+	all, err := s.List()
+	require.NoError(t, err)
+	assert.Equal(t, map[int]session.Session{1: {Step: 2}}, all)
+}
+
+func TestFileWrongDirError(t *testing.T) {
+	s := session.NewFile("nowherefound")
+	assert.Error(t, s.Save(1, session.Session{}))
+
+	_, err := s.List()
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package story
+
+// Branch is an alternative expectation of a Step.
+// When it is met, the story goes to the step with the target ID instead of the next one.
+// A Branch without its own expectation is met when the expectation of the Step is met.
+// A Branch with a condition is only considered when the condition holds for the story variables.
+type Branch struct {
+	expectation string
+	target      string
+	responses   []string
+	condition   string
+	sets        []string
+	media       map[int]*Media
+	additional  map[int]map[string]interface{}
+}
+
+// NewBranch returns a new Branch
+func NewBranch() *Branch {
+	return &Branch{}
+}
+
+// Expectation returns expected message to go to the target step
+func (b *Branch) Expectation() string {
+	return b.expectation
+}
+
+// Target returns ID of the step the Branch leads to
+func (b *Branch) Target() string {
+	return b.target
+}
+
+// Responses returns responses of the Branch
+func (b *Branch) Responses() []string {
+	return b.responses
+}
+
+// Condition returns the condition which should hold for the Branch to be considered
+func (b *Branch) Condition() string {
+	return b.condition
+}
+
+// When sets the condition on story variables, like "visited" or "score >= 2",
+// which should hold for the Branch to be considered
+func (b *Branch) When(cond string) *Branch {
+	b.condition = cond
+	return b
+}
+
+// Set sets assignments of story variables which are applied when the Branch is taken
+func (b *Branch) Set(exprs ...string) *Branch {
+	b.sets = append(b.sets, exprs...)
+	return b
+}
+
+// Expect sets expected message for the Branch
+func (b *Branch) Expect(e string) *Branch {
+	b.expectation = e
+	return b
+}
+
+// Goto sets ID of the step the Branch leads to
+func (b *Branch) Goto(id string) *Branch {
+	b.target = id
+	return b
+}
+
+// Respond sets responses for the Branch.
+// If they are not set, responses of the Step are used.
+func (b *Branch) Respond(r ...string) *Branch {
+	b.responses = r
+	return b
+}
+
+// Media makes the response of the Branch with the index be sent as media, like Step.Media
+func (b *Branch) Media(i int, m Media) *Branch {
+	if b.media == nil {
+		b.media = make(map[int]*Media)
+	}
+
+	b.media[i] = &m
+	return b
+}
+
+// Additional sets a field of the response of the Branch with the index, like Step.Additional
+func (b *Branch) Additional(i int, field string, value interface{}) *Branch {
+	if b.additional == nil {
+		b.additional = make(map[int]map[string]interface{})
+	}
+	if b.additional[i] == nil {
+		b.additional[i] = make(map[string]interface{})
+	}
+
+	b.additional[i][field] = value
+	return b
+}
+
+func (b *Branch) mediaOr(s *Step) map[int]*Media {
+	if b.responses != nil {
+		return b.media
+	}
+
+	return s.media
+}
+
+// additionalOr returns additional fields of the responses which are sent,
+// so delays of the Step are not applied to responses of the Branch
+func (b *Branch) additionalOr(s *Step) map[int]map[string]interface{} {
+	if b.responses != nil {
+		return b.additional
+	}
+
+	return s.additional
+}
+
+func (b *Branch) responsesOr(s *Step) []string {
+	if b.responses != nil {
+		return b.responses
+	}
+
+	return s.Responses()
+}
+
+func (b *Branch) targetOr(s *Step) string {
+	if b.target != "" {
+		return b.target
+	}
+
+	return s.target
+}
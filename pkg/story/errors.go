@@ -0,0 +1,191 @@
+package story
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var errNotArray = errors.New("story should be an array of steps or an object with steps")
+
+// errTwoKeyboards is returned when a step has both buttons and inline buttons
+var errTwoKeyboards = errors.New("step can have either buttons or inline buttons")
+
+// errNoResponses is returned when a step has no responses and not all of its branches have their own
+var errNoResponses = errors.New("step should have responses")
+
+// errNoMediaURL is returned when a structured media response has no URL
+var errNoMediaURL = errors.New("media response should have url")
+
+// errAlbumItems is returned when an album has too few or too many items
+var errAlbumItems = errors.New("album should have from 2 to 10 items")
+
+// LoadError is returned when a story or i18n cannot be loaded.
+// Step is the index of the step in the file or -1 if the error is not about a particular step.
+// Field is the name of the field with the error, if known.
+// Line and Column point to the error in the file starting from 1, they are 0 if unknown.
+type LoadError struct {
+	Step         int
+	Field        string
+	Line, Column int
+	Err          error
+}
+
+// Error implements error
+func (e *LoadError) Error() string {
+	var where []string
+	if e.Step >= 0 {
+		where = append(where, fmt.Sprintf("step %d", e.Step))
+	}
+	if e.Field != "" {
+		where = append(where, fmt.Sprintf("field %q", e.Field))
+	}
+	if e.Line > 0 {
+		where = append(where, fmt.Sprintf("line %d, column %d", e.Line, e.Column))
+	}
+
+	if len(where) == 0 {
+		return fmt.Sprintf("story: %v", e.Err)
+	}
+	return fmt.Sprintf("story: %s: %v", strings.Join(where, ", "), e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+var unknownFieldRe = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+// stepError converts a decoding error of a step to LoadError with the field name
+func stepError(i int, err error) *LoadError {
+	le := &LoadError{Step: i, Err: err}
+
+	var te *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &te):
+		le.Field = te.Field
+	case unknownFieldRe.MatchString(err.Error()):
+		le.Field = unknownFieldRe.FindStringSubmatch(err.Error())[1]
+		le.Err = errors.New("unknown field")
+	}
+
+	return le
+}
+
+// jsonSource keeps a loaded JSON file to point at errors in it
+type jsonSource struct {
+	data   []byte
+	starts []int
+	raws   []json.RawMessage
+}
+
+// syntaxError converts an error which occurred after reading offset bytes to LoadError
+func (src *jsonSource) syntaxError(i int, err error, offset int64) *LoadError {
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		offset = se.Offset
+	}
+	if offset > 0 {
+		offset--
+	}
+
+	le := &LoadError{Step: i, Err: err}
+	le.Line, le.Column = src.position(int(offset))
+	return le
+}
+
+// locate sets line and column of LoadError using the step and the field of the error
+func (src *jsonSource) locate(err error) error {
+	var le *LoadError
+	if !errors.As(err, &le) || le.Step < 0 || le.Step >= len(src.starts) {
+		return err
+	}
+
+	offset := src.starts[le.Step]
+	if le.Field != "" {
+		if i := keyOffset(src.raws[le.Step], le.Field); i >= 0 {
+			offset += i
+		}
+	}
+
+	le.Line, le.Column = src.position(offset)
+	return le
+}
+
+// keyOffset returns the offset of the key of the field in the JSON object, or -1 if there is no such key.
+// The field can be a path of nested keys, like "expectGeo.lat", then the last keys should match it.
+// Only keys are compared, so the name inside a string value is not taken for the field.
+func keyOffset(raw []byte, field string) int {
+	want := strings.ToLower(field)
+	depth := strings.Count(want, ".") + 1
+
+	// frame is an object or an array the decoder is in
+	type frame struct {
+		object, atKey bool
+		key           string
+	}
+	var stack []*frame
+	valueEnded := func() {
+		if n := len(stack); n > 0 && stack[n-1].object {
+			stack[n-1].atKey = true
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return -1
+		}
+
+		switch v := t.(type) {
+		case json.Delim:
+			switch v {
+			case '{':
+				stack = append(stack, &frame{object: true, atKey: true})
+			case '[':
+				stack = append(stack, &frame{})
+			default:
+				stack = stack[:len(stack)-1]
+				valueEnded()
+			}
+		case string:
+			top := stack[len(stack)-1]
+			if !top.object || !top.atKey {
+				valueEnded()
+				continue
+			}
+			top.key, top.atKey = strings.ToLower(v), false
+
+			var path []string
+			for _, f := range stack {
+				if f.object {
+					path = append(path, f.key)
+				}
+			}
+			if len(path) >= depth && strings.Join(path[len(path)-depth:], ".") == want {
+				// The key ends right before the offset of the decoder
+				end := int(dec.InputOffset())
+				return bytes.LastIndexByte(raw[:end-1], '"')
+			}
+		default:
+			valueEnded()
+		}
+	}
+}
+
+// position converts byte offset in the file to line and column
+func (src *jsonSource) position(offset int) (int, int) {
+	if offset > len(src.data) {
+		offset = len(src.data)
+	}
+
+	before := src.data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := offset - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
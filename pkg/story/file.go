@@ -0,0 +1,27 @@
+package story
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadFile loads a story from a file: YAML if it has .yaml or .yml extension, JSON otherwise
+func LoadFile(path string) (*Story, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return New(), err
+	}
+	defer f.Close()
+
+	if IsYAML(path) {
+		return LoadYAML(f)
+	}
+	return Load(f)
+}
+
+// IsYAML returns whether the path has YAML extension
+func IsYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
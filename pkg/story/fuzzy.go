@@ -0,0 +1,54 @@
+package story
+
+import (
+	"strings"
+	"unicode"
+)
+
+// normalize prepares a message for fuzzy matching:
+// it lowercases the message, folds Russian yo, drops punctuation and collapses whitespace
+func normalize(m string) string {
+	m = fixRussianYo(strings.ToLower(m))
+	m = strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return ' '
+		}
+		return r
+	}, m)
+
+	return strings.Join(strings.Fields(m), " ")
+}
+
+// editDistance returns Levenshtein distance between two strings in runes
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func minInt(xs ...int) int {
+	m := xs[0]
+	for _, x := range xs[1:] {
+		if x < m {
+			m = x
+		}
+	}
+	return m
+}
@@ -0,0 +1,227 @@
+package story
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// graphLabelLen is a maximum length of a line in graph labels, longer lines are cut
+const graphLabelLen = 40
+
+type graphNode struct {
+	id, label string
+}
+
+type graphEdge struct {
+	from, to, label string
+	dashed          bool
+}
+
+type graphGroup struct {
+	id, label string
+	nodes     []graphNode
+}
+
+// graph is a flow diagram of the story, which can be rendered in different formats
+type graph struct {
+	groups []graphGroup
+	edges  []graphEdge
+}
+
+// WriteDOT writes the story as a Graphviz DOT flow diagram.
+// Ordered steps are connected by their expectations, fail messages are loops,
+// commands and unordered steps are grouped separately.
+func (s *Story) WriteDOT(w io.Writer) error {
+	g := s.graph()
+	b := &strings.Builder{}
+
+	b.WriteString("digraph story {\n\tnode [shape=box];\n")
+	for _, gr := range g.groups {
+		fmt.Fprintf(b, "\tsubgraph cluster_%s {\n\t\tlabel=%s;\n", gr.id, dotQuote(gr.label))
+		for _, n := range gr.nodes {
+			fmt.Fprintf(b, "\t\t%s [label=%s];\n", n.id, dotQuote(n.label))
+		}
+		b.WriteString("\t}\n")
+	}
+	for _, e := range g.edges {
+		style := ""
+		if e.dashed {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(b, "\t%s -> %s [label=%s%s];\n", e.from, e.to, dotQuote(e.label), style)
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteMermaid writes the story as a Mermaid flowchart.
+// It has the same structure as WriteDOT.
+func (s *Story) WriteMermaid(w io.Writer) error {
+	g := s.graph()
+	b := &strings.Builder{}
+
+	b.WriteString("flowchart TD\n")
+	for _, gr := range g.groups {
+		fmt.Fprintf(b, "\tsubgraph %s [%s]\n", gr.id, mermaidQuote(gr.label))
+		for _, n := range gr.nodes {
+			fmt.Fprintf(b, "\t\t%s[%s]\n", n.id, mermaidQuote(n.label))
+		}
+		b.WriteString("\tend\n")
+	}
+	for _, e := range g.edges {
+		arrow := "-->"
+		if e.dashed {
+			arrow = "-.->"
+		}
+		fmt.Fprintf(b, "\t%s %s|%s| %s\n", e.from, arrow, mermaidQuote(e.label), e.to)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (s *Story) graph() graph {
+	var g graph
+
+	steps := graphGroup{id: "steps", label: "Steps"}
+	for i, stp := range s.steps {
+		from := stepNodeID(i)
+		title := fmt.Sprintf("Step %d", i)
+		if stp.id != "" {
+			title += " (" + stp.id + ")"
+		}
+		steps.nodes = append(steps.nodes, graphNode{from, stepLabel(title, stp)})
+
+		for _, b := range stp.branches {
+			label := b.expectation
+			if label == "" {
+				label = stepExpectationLabel(stp)
+			}
+			if b.condition != "" {
+				label += " [when " + b.condition + "]"
+			}
+			for _, r := range b.responses {
+				label += "\n" + cutLabel(r)
+			}
+			g.edges = append(g.edges, graphEdge{from: from, to: stepNodeID(s.rotateStep(s.target(b.targetOr(stp), i))), label: label})
+		}
+
+		// A step with branches only has nothing else to expect
+		if label := stepExpectationLabel(stp); label != "" || len(stp.branches) == 0 {
+			g.edges = append(g.edges, graphEdge{from: from, to: stepNodeID(s.rotateStep(s.target(stp.target, i))), label: label})
+		}
+
+		if fail := stp.failLabel(); fail != "" {
+			g.edges = append(g.edges, graphEdge{from: from, to: from, label: fail, dashed: true})
+		}
+	}
+	if len(steps.nodes) > 0 {
+		g.groups = append(g.groups, steps)
+	}
+
+	for _, kind := range []struct {
+		id, label, prefix string
+		steps             map[string]*Step
+	}{
+		{"commands", "Commands", "/", s.cmds},
+		{"unordered", "Unordered", "", s.unordered},
+	} {
+		gr := graphGroup{id: kind.id, label: kind.label}
+		for i, key := range sortedStepKeys(kind.steps) {
+			stp := kind.steps[key]
+			id := fmt.Sprintf("%s%d", kind.id, i)
+			gr.nodes = append(gr.nodes, graphNode{id, stepLabel(kind.prefix+key, stp)})
+
+			if t, ok := s.ids[stp.target]; ok {
+				g.edges = append(g.edges, graphEdge{from: id, to: stepNodeID(t), label: "goto", dashed: true})
+			}
+		}
+		if len(gr.nodes) > 0 {
+			g.groups = append(g.groups, gr)
+		}
+	}
+
+	return g
+}
+
+func stepNodeID(i int) string {
+	return fmt.Sprintf("step%d", i)
+}
+
+func sortedStepKeys(m map[string]*Step) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// stepLabel returns a title of the step followed by its responses, delayed ones are marked with the delay
+func stepLabel(title string, stp *Step) string {
+	lines := []string{strings.TrimSpace(title)}
+	for i, r := range stp.responses {
+		if m, ok := stp.media[i]; ok && m.Type != MediaText {
+			r = strings.TrimSpace(fmt.Sprintf("[%s] %s", m.Type, r))
+		}
+		if t, ok := stp.additional[i]["time"].(time.Duration); ok {
+			r = fmt.Sprintf("(+%s) %s", t, r)
+		}
+		lines = append(lines, cutLabel(r))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// stepExpectationLabel describes what the step expects to go on
+func stepExpectationLabel(stp *Step) string {
+	switch {
+	case stp.store != nil:
+		return "[save any message]"
+	case stp.isGeo:
+		return fmt.Sprintf("[geo %g,%g ±%gm]", stp.geoExp[0], stp.geoExp[1], stp.geoExp[2])
+	case stp.regex != nil:
+		return cutLabel("/" + stp.pattern + "/")
+	case stp.anyOf != nil:
+		return cutLabel(strings.Join(stp.anyOf, " | "))
+	}
+
+	return cutLabel(stp.expectation)
+}
+
+func (s *Step) failLabel() string {
+	fails := s.hints
+	if len(fails) == 0 && s.failMessage != "" {
+		fails = []string{s.failMessage}
+	}
+	if len(fails) == 0 {
+		return ""
+	}
+
+	return cutLabel("fail: " + strings.Join(fails, " / "))
+}
+
+func cutLabel(l string) string {
+	r := []rune(l)
+	if len(r) <= graphLabelLen {
+		return l
+	}
+
+	return string(r[:graphLabelLen-1]) + "…"
+}
+
+func dotQuote(l string) string {
+	l = strings.ReplaceAll(l, `\`, `\\`)
+	l = strings.ReplaceAll(l, `"`, `\"`)
+	return `"` + strings.ReplaceAll(l, "\n", `\n`) + `"`
+}
+
+func mermaidQuote(l string) string {
+	l = strings.ReplaceAll(l, `"`, "#quot;")
+	return `"` + strings.ReplaceAll(l, "\n", "<br/>") + `"`
+}
@@ -0,0 +1,66 @@
+package story_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func graphStory() *story.Story {
+	return story.New().
+		Add(story.NewStep().Expect("start").Respond("hello", "later").Fail("say \"start\"").
+			Additional(1, "time", time.Minute)).
+		Add(story.NewStep().ExpectGeo(43, 76, 50).Respond("found").Hint("north", "east")).
+		Add(story.NewStep().
+			Branch(story.NewBranch().Expect("left").Goto("end").Respond("going left"))).
+		Add(story.NewStep().ExpectSave(&stubStore{}).Respond("saved")).
+		Add(story.NewStep().As("end").Expect("finish").Respond("the end")).
+		AddCommand(story.NewStep().Expect("end").Respond("jump").Goto("end")).
+		AddUnordered(story.NewStep().Expect("help").Respond("helping"))
+}
+
+func TestWriteDOT(t *testing.T) {
+	b := &bytes.Buffer{}
+	err := graphStory().WriteDOT(b)
+	require.NoError(t, err, "unexpected error writing graph")
+
+	for _, want := range []string{
+		"digraph story {",
+		`step0 [label="Step 0\nhello\n(+1m0s) later"];`,
+		`step0 -> step1 [label="start"];`,
+		`step0 -> step0 [label="fail: say \"start\"", style=dashed];`,
+		`step1 -> step2 [label="[geo 43,76 ±50m]"];`,
+		`step1 -> step1 [label="fail: north / east", style=dashed];`,
+		`step2 -> step4 [label="left\ngoing left"];`,
+		`step3 -> step4 [label="[save any message]"];`,
+		`step4 [label="Step 4 (end)\nthe end"];`,
+		`step4 -> step0 [label="finish"];`,
+		`commands0 [label="/end\njump"];`,
+		`commands0 -> step4 [label="goto", style=dashed];`,
+		`unordered0 [label="help\nhelping"];`,
+	} {
+		assert.Contains(t, b.String(), want)
+	}
+	assert.NotContains(t, b.String(), `step2 -> step3`, "want no edge for step with branches only")
+}
+
+func TestWriteMermaid(t *testing.T) {
+	b := &bytes.Buffer{}
+	err := graphStory().WriteMermaid(b)
+	require.NoError(t, err, "unexpected error writing graph")
+
+	for _, want := range []string{
+		"flowchart TD",
+		`subgraph steps ["Steps"]`,
+		`step0["Step 0<br/>hello<br/>(+1m0s) later"]`,
+		`step0 -->|"start"| step1`,
+		`step0 -.->|"fail: say #quot;start#quot;"| step0`,
+		`commands0 -.->|"goto"| step4`,
+	} {
+		assert.Contains(t, b.String(), want)
+	}
+}
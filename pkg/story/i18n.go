@@ -2,6 +2,7 @@ package story
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 )
 
@@ -14,11 +15,29 @@ const (
 // It uses English by default as indexes to find appropriate translations in other languages.
 type I18nMap map[string]map[string]string
 
-// LoadI18n loads i18n from json file to the struct
+// LoadI18n loads i18n from json file to the struct.
+// All errors are returned as *LoadError.
 func LoadI18n(r io.Reader) (I18nMap, error) {
 	m := make(I18nMap)
-	err := json.NewDecoder(r).Decode(&m)
-	return m, err
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return m, &LoadError{Step: -1, Err: err}
+	}
+
+	src := &jsonSource{data: data}
+	err = json.Unmarshal(data, &m)
+
+	var te *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &te):
+		le := src.syntaxError(-1, err, te.Offset)
+		le.Field = te.Field
+		return m, le
+	case err != nil:
+		return m, src.syntaxError(-1, err, 0)
+	}
+
+	return m, nil
 }
 
 // Line returns a translated line from I18n
@@ -31,15 +50,23 @@ func (m I18nMap) Line(line, lang string) string {
 	return l
 }
 
+// Translate translates responses to the language, keeping everything else about them
 func (m I18nMap) Translate(rs []Response, lang string) []Response {
 	result := make([]Response, len(rs))
 
 	for i, r := range rs {
 		result[i] = Response{
+			Additional:    r.Additional,
 			original:      r.original,
 			text:          m.Line(r.original, lang),
 			lang:          lang,
 			shouldAdvance: r.shouldAdvance,
+			failed:        r.failed,
+			next:          r.next,
+			keyboard:      r.buttons.translate(m, lang),
+			buttons:       r.buttons,
+			media:         r.sourceMedia.translate(m, lang),
+			sourceMedia:   r.sourceMedia,
 		}
 	}
 	return result
@@ -56,3 +56,12 @@ func TestI18nTranslateResponses(t *testing.T) {
 		assert.Equal(t, "cmdResponse", localized[0].Text())
 	})
 }
+
+func TestI18nLoadingErrorPosition(t *testing.T) {
+	_, err := story.LoadI18n(strings.NewReader("{\n  \"ru\": {\n    \"step 1\": 1\n  }\n}"))
+
+	var le *story.LoadError
+	require.ErrorAs(t, err, &le, "want LoadError")
+	assert.Equal(t, 3, le.Line, "want line of the error")
+	assert.Equal(t, "ru.step 1", le.Field, "want field of the error")
+}
@@ -1,8 +1,13 @@
 package story
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/asahnoln/mesproc/pkg/store"
@@ -14,73 +19,330 @@ type JSONExpectGeo struct {
 	Precision float64
 }
 
+// JSONBranch is a struct for step branch in JSON file
+type JSONBranch struct {
+	Expect    string
+	When      string
+	Set       []string
+	Goto      string
+	Response  *JSONResponse
+	Responses []JSONResponse
+	Later     map[int]time.Duration
+}
+
+// JSONStory is a struct for a story file with settings of the whole story.
+// Tolerance is the default tolerance of steps.
+type JSONStory struct {
+	Tolerance int
+	Steps     []JSONStep
+}
+
 // JSONStep is a struct for step in JSON file
 type JSONStep struct {
-	Command    bool
-	Unordered  bool
-	Expect     *string
-	Response   *string
-	Fail       string
-	Responses  []string
-	ExpectGeo  *JSONExpectGeo
-	ExpectSave *string
-	Later      map[int]time.Duration
+	ID            string
+	Goto          string
+	Command       bool
+	Unordered     bool
+	Expect        *string
+	ExpectAny     []string
+	ExpectRegex   *string
+	Tolerance     *int
+	Response      *JSONResponse
+	Fail          string
+	Hints         []string
+	AdvanceAfter  int
+	Responses     []JSONResponse
+	ExpectGeo     *JSONExpectGeo
+	ExpectSave    *string
+	Later         map[int]time.Duration
+	Branches      []JSONBranch
+	Set           []string
+	Buttons       [][]string
+	InlineButtons [][]string
 }
 
 // Load loads story steps from given JSON file. Structure should be as follows:
-//   [
-//     {
-//       "command": true,
-//       "expect": "start",
-//       "response": "let's start"
-//     },
-//     {
-//       "expect": "go to step 2",
-//       "response": "now at step 2",
-//       "fail": "still at step 1"
-//     },
-//     {
-//       "expectGeo": {
-//         "lat": 43.257169,
-//         "lon": 76.924515,
-//         "precision": 50
-//       },
-//       "response": "proper geo",
-//       "fail": "still waiting for geo"
-//     },
-//     {
-//       "expect": "finish",
-//       "response": "now finished",
-//       "fail": "still at step 2"
-//     }
-//   ]
+//
+//	[
+//	  {
+//	    "command": true,
+//	    "expect": "start",
+//	    "response": "let's start"
+//	  },
+//	  {
+//	    "expect": "go to step 2",
+//	    "response": "now at step 2",
+//	    "fail": "still at step 1"
+//	  },
+//	  {
+//	    "expectAny": ["knit", "knitting"],
+//	    "tolerance": 2,
+//	    "response": "let's knit",
+//	    "fail": "what do we do?"
+//	  },
+//	  {
+//	    "expectRegex": "^(the )?red (door|gate)$",
+//	    "response": "it opens",
+//	    "hints": ["think about colour", "it's something red", "the answer is 'red door'"],
+//	    "advanceAfter": 5
+//	  },
+//	  {
+//	    "expectGeo": {
+//	      "lat": 43.257169,
+//	      "lon": 76.924515,
+//	      "precision": 50
+//	    },
+//	    "response": "proper geo",
+//	    "fail": "still waiting for geo"
+//	  },
+//	  {
+//	    "branches": [
+//	      {"expect": "left", "goto": "garden"},
+//	      {"expect": "right", "goto": "cellar", "responses": ["it's dark here", "and cold"], "later": {"1": 60}}
+//	    ],
+//	    "response": "choose your way",
+//	    "fail": "left or right?"
+//	  },
+//	  {
+//	    "id": "garden",
+//	    "set": ["visited_garden = true", "score += 1"],
+//	    "expect": "finish",
+//	    "response": "now finished",
+//	    "fail": "still in the garden"
+//	  },
+//	  {
+//	    "id": "cellar",
+//	    "expect": "finish",
+//	    "response": "now finished",
+//	    "fail": "still in the cellar"
+//	  },
+//	  {
+//	    "command": true,
+//	    "expect": "cellar",
+//	    "response": "jumping to the cellar",
+//	    "goto": "cellar"
+//	  },
+//	  {
+//	    "expect": "listen",
+//	    "responses": [
+//	      "audio:http://example.com/short.mp3",
+//	      {"type": "audio", "url": "http://example.com/long.mp3", "caption": "<b>part 2</b>", "parseMode": "HTML"},
+//	      {"type": "text", "text": "photo: is just a word here"}
+//	    ],
+//	    "fail": "say listen"
+//	  },
+//	  {
+//	    "expect": "take",
+//	    "buttons": [["take", "leave"]],
+//	    "response": "you have the key",
+//	    "fail": "take or leave?"
+//	  },
+//	  {
+//	    "expect": "open",
+//	    "branches": [
+//	      {"when": "visited_garden && score >= 1", "response": "good ending"}
+//	    ],
+//	    "response": "bad ending"
+//	  }
+//	]
+//
+// "later" delays responses with given indexes by seconds. Branches with their own responses have their own "later".
+// Every "goto" should refer to an "id" of an existing step, otherwise an error is returned.
+// Every step should have responses, unless all its branches have their own.
+// Every "set" and "when" should be a proper expression, otherwise an error is returned as well.
+// Responses are either strings or objects with "type" (one of MediaTypes), "url" for media,
+// "text" or "caption" which is translated and "parseMode".
+// Buttons are offered when the story comes to the step, "inlineButtons" are attached to the message
+// instead of the keyboard. A step can have only one of them.
+// Labels of inline buttons are sent back by Telegram, which allows them 64 bytes at most.
+//
+// The story can also be an object with settings of the whole story and the array of steps:
+//
+//	{
+//	  "tolerance": 1,
+//	  "steps": [...]
+//	}
+//
+// The tolerance of the story is used by steps without their own one.
+//
+// Unknown fields are not allowed. All errors are returned as *LoadError.
 func Load(r io.Reader) (*Story, error) {
-	s := New()
-	steps := make([]JSONStep, 0)
-	err := json.NewDecoder(r).Decode(&steps)
+	js, src, err := decodeStory(r)
 	if err != nil {
-		return s, err
+		return New(), err
 	}
 
-	for _, ss := range steps {
-		step := NewStep().Fail(ss.Fail)
+	s, err := build(js)
+	if err != nil {
+		return s, src.locate(err)
+	}
+
+	return s, nil
+}
 
+// decodeStory strictly decodes the story, which is either an array of steps
+// or an object with settings and steps
+func decodeStory(r io.Reader) (JSONStory, *jsonSource, error) {
+	var js JSONStory
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return js, nil, &LoadError{Step: -1, Err: err}
+	}
+
+	src := &jsonSource{data: data}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	t, err := dec.Token()
+	if err != nil {
+		return js, src, src.syntaxError(-1, err, dec.InputOffset())
+	}
+	if t == json.Delim('[') {
+		js.Steps, err = src.decodeSteps(dec)
+		return js, src, err
+	}
+	if t != json.Delim('{') {
+		return js, src, src.syntaxError(-1, errNotArray, dec.InputOffset())
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return js, src, src.syntaxError(-1, err, dec.InputOffset())
+		}
+		key, _ := t.(string)
+		// Errors point at the quoted key
+		offset := dec.InputOffset() - int64(len(key)+2)
+
+		switch strings.ToLower(key) {
+		case "tolerance":
+			err = dec.Decode(&js.Tolerance)
+		case "steps":
+			if t, err = dec.Token(); err == nil && t != json.Delim('[') {
+				err = errNotArray
+			}
+			if err == nil {
+				js.Steps, err = src.decodeSteps(dec)
+			}
+		default:
+			// Most likely a step outside of the array
+			err = errNotArray
+		}
+
+		var le *LoadError
 		switch {
-		case ss.Response != nil:
-			step.Respond(*ss.Response)
-		case ss.Responses != nil:
-			step.Respond(ss.Responses...)
+		case errors.As(err, &le):
+			return js, src, err
+		case err != nil:
+			le = src.syntaxError(-1, err, offset+1)
+			le.Field = key
+			return js, src, le
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return js, src, src.syntaxError(-1, err, dec.InputOffset())
+	}
+
+	return js, src, nil
+}
+
+// decodeSteps strictly decodes steps one by one after the beginning of the array,
+// remembering where each of them starts, so errors could point to the exact step, field and position in the file
+func (src *jsonSource) decodeSteps(dec *json.Decoder) ([]JSONStep, error) {
+	steps := make([]JSONStep, 0)
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, src.syntaxError(i, err, dec.InputOffset())
+		}
+		src.starts = append(src.starts, int(dec.InputOffset())-len(raw))
+		src.raws = append(src.raws, raw)
+
+		var ss JSONStep
+		if err := strictUnmarshal(raw, &ss); err != nil {
+			return nil, src.locate(stepError(i, err))
+		}
+		steps = append(steps, ss)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, src.syntaxError(-1, err, dec.InputOffset())
+	}
+
+	return steps, nil
+}
+
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// build creates a Story from the decoded story
+func build(js JSONStory) (*Story, error) {
+	s := New().Tolerate(js.Tolerance)
+	steps := js.Steps
+	for i, ss := range steps {
+		if _, ok := s.ids[ss.ID]; ok {
+			return s, &LoadError{Step: i, Field: "id", Err: fmt.Errorf("%q: %w", ss.ID, ErrDuplicateStep)}
+		}
+
+		field, err := checkExpressions(ss)
+		if err != nil {
+			return s, &LoadError{Step: i, Field: field, Err: err}
+		}
+
+		step := NewStep().As(ss.ID).Goto(ss.Goto).Set(ss.Set...).
+			Fail(ss.Fail).Hint(ss.Hints...).AdvanceAfter(ss.AdvanceAfter)
+
+		if rs := ss.responses(); rs != nil {
+			lines, media := jsonResponses(rs)
+			step.Respond(lines...)
+			for i, m := range media {
+				step.Media(i, *m)
+			}
 		}
 
 		switch {
 		case ss.Expect != nil:
 			step = step.Expect(*ss.Expect)
+		case ss.ExpectAny != nil:
+			step = step.ExpectAny(ss.ExpectAny...)
+		case ss.ExpectRegex != nil:
+			step = step.ExpectRegex(*ss.ExpectRegex)
 		case ss.ExpectGeo != nil:
 			step = step.ExpectGeo(ss.ExpectGeo.Lat, ss.ExpectGeo.Lon, ss.ExpectGeo.Precision)
 		case ss.ExpectSave != nil:
 			step = step.ExpectSave(store.NewFile(*ss.ExpectSave))
 		}
 
+		for _, b := range ss.Branches {
+			branch := NewBranch().Expect(b.Expect).When(b.When).Set(b.Set...).Goto(b.Goto)
+			if rs := b.responses(); rs != nil {
+				lines, media := jsonResponses(rs)
+				branch.Respond(lines...)
+				for i, m := range media {
+					branch.Media(i, *m)
+				}
+			}
+			for i, t := range b.Later {
+				branch.Additional(i, "time", time.Second*t)
+			}
+			step.Branch(branch)
+		}
+
+		switch {
+		case ss.Buttons != nil && ss.InlineButtons != nil:
+			return s, &LoadError{Step: i, Field: "inlineButtons", Err: errTwoKeyboards}
+		case ss.Buttons != nil:
+			step.Buttons(ss.Buttons...)
+		case ss.InlineButtons != nil:
+			step.InlineButtons(ss.InlineButtons...)
+		}
+
+		if ss.Tolerance != nil {
+			step.Tolerate(*ss.Tolerance)
+		}
+
 		if ss.Later != nil {
 			for i, t := range ss.Later {
 				step.Additional(i, "time", time.Second*t)
@@ -97,5 +359,81 @@ func Load(r io.Reader) (*Story, error) {
 		}
 	}
 
-	return s, nil
+	if err := checkTargets(s, steps); err != nil {
+		return s, err
+	}
+	return s, checkResponses(steps)
+}
+
+// checkResponses returns an error if any step has nothing to respond with when it is met
+func checkResponses(steps []JSONStep) error {
+	for i, ss := range steps {
+		if len(ss.responses()) == 0 && !ss.branchesRespond() {
+			return &LoadError{Step: i, Field: "responses", Err: errNoResponses}
+		}
+	}
+
+	return nil
+}
+
+// checkTargets returns an error if any step or branch leads to a step which doesn't exist
+func checkTargets(s *Story, steps []JSONStep) error {
+	for i, ss := range steps {
+		if _, ok := s.ids[ss.Goto]; ss.Goto != "" && !ok {
+			return &LoadError{Step: i, Field: "goto", Err: fmt.Errorf("%q: %w", ss.Goto, ErrUnknownStep)}
+		}
+
+		for _, b := range ss.Branches {
+			if _, ok := s.ids[b.Goto]; b.Goto != "" && !ok {
+				return &LoadError{Step: i, Field: "branches", Err: fmt.Errorf("%q: %w", b.Goto, ErrUnknownStep)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkExpressions returns an error and the field with it
+// if any regular expression, variable assignment, condition or structured response of the step is wrong
+func checkExpressions(ss JSONStep) (string, error) {
+	if ss.ExpectRegex != nil {
+		if _, err := regexp.Compile(expectationRegex(*ss.ExpectRegex)); err != nil {
+			return "expectRegex", fmt.Errorf("%q: %w", *ss.ExpectRegex, err)
+		}
+	}
+
+	for _, e := range ss.Set {
+		if _, err := parseAssignment(e); err != nil {
+			return "set", err
+		}
+	}
+
+	for _, r := range ss.responses() {
+		if err := r.check(); err != nil {
+			return "responses", err
+		}
+	}
+
+	for _, b := range ss.Branches {
+		for _, r := range b.responses() {
+			if err := r.check(); err != nil {
+				return "branches", err
+			}
+		}
+
+		for _, e := range b.Set {
+			if _, err := parseAssignment(e); err != nil {
+				return "branches", err
+			}
+		}
+
+		if b.When == "" {
+			continue
+		}
+		if _, err := parseCondition(b.When); err != nil {
+			return "branches", err
+		}
+	}
+
+	return "", nil
 }
@@ -48,6 +48,47 @@ func TestLoadingFromJSON(t *testing.T) {
 		assert.Equal(t, "saved!", str.ResponsesWithLangStepTo(4, "", "I want this saved")[0].Text(), "want response message to saving expectation")
 	})
 
+	t.Run("Branches", func(t *testing.T) {
+		rs := str.ResponsesWithLangStepTo(5, "", "right")
+		assert.Equal(t, "it's dark here", rs[0].Text(), "want branch response")
+		assert.Equal(t, 7, rs[0].Next(), "want branch to lead to named step")
+		assert.Equal(t, "choose your way", str.ResponsesWithLangStepTo(5, "", "left")[0].Text(), "want step response for branch without own responses")
+		assert.Equal(t, 6, str.ResponsesWithLangStepTo(5, "", "left")[0].Next(), "want branch to lead to named step")
+	})
+
+	t.Run("Goto command", func(t *testing.T) {
+		rs := str.ResponsesWithLangStepTo(1, "", "/cellar")
+		assert.Equal(t, "jumping to the cellar", rs[0].Text())
+		assert.Equal(t, 7, rs[0].Next(), "want command to jump to named step")
+	})
+
+	t.Run("Variables", func(t *testing.T) {
+		st := &story.State{Step: 5}
+		str.ResponsesTo(st, "left")
+		assert.Equal(t, story.Vars{"visited_garden": 1}, st.Vars, "want variables set by branch")
+
+		st.Step = 6
+		assert.Equal(t, "good ending", str.ResponsesTo(st, "look")[0].Text(), "want conditional response")
+	})
+
+	t.Run("Several expectations", func(t *testing.T) {
+		assert.Equal(t, "let's knit", str.ResponsesWithLangStepTo(8, "", "knitting")[0].Text(), "want response to any of expectations")
+		assert.Equal(t, "it opens", str.ResponsesWithLangStepTo(9, "", "the red gate")[0].Text(), "want response to regular expression")
+		assert.Equal(t, "let's knit", str.ResponsesWithLangStepTo(8, "", "kniting")[0].Text(), "want response to mistyped expectation")
+	})
+
+	t.Run("Hints", func(t *testing.T) {
+		assert.Equal(t, "it's something red", str.ResponsesTo(&story.State{Step: 9, Fails: 1}, "door")[0].Text(), "want hint for second attempt")
+		assert.Equal(t, 10, str.ResponsesTo(&story.State{Step: 9, Fails: 4}, "door")[0].Next(), "want advance after several fails")
+	})
+
+	t.Run("Buttons", func(t *testing.T) {
+		rs := str.ResponsesWithLangStepTo(4, "", "I want this saved")
+		assert.Equal(t, &story.Keyboard{Rows: [][]string{{"left", "right"}}}, rs[len(rs)-1].Keyboard(), "want buttons of the next step")
+		assert.Equal(t, &story.Keyboard{Rows: [][]string{{"left", "right"}}}, str.ResponsesWithLangStepTo(5, "", "up")[0].Keyboard(), "want buttons offered again on fail")
+		assert.Nil(t, str.ResponsesWithLangStepTo(5, "", "left")[0].Keyboard(), "want no buttons for the step without them")
+	})
+
 	t.Run("Additional info", func(t *testing.T) {
 		rs := str.ResponsesWithLangStepTo(3, "", "multi")
 		assert.Equal(t, time.Second*600, rs[2].Additional["time"], "want time field on 3rd response of 4th step")
@@ -59,3 +100,165 @@ func TestErrorLoadingFromJSON(t *testing.T) {
 
 	require.Error(t, err, "want error when loading wrong json")
 }
+
+func TestErrorLoadingReferencesFromJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want error
+	}{
+		{"dangling step goto", `[{"expect": "a", "goto": "nowhere"}]`, story.ErrUnknownStep},
+		{"dangling branch goto", `[{"branches": [{"expect": "a", "goto": "nowhere"}]}]`, story.ErrUnknownStep},
+		{"dangling command goto", `[{"command": true, "expect": "a", "goto": "nowhere"}]`, story.ErrUnknownStep},
+		{"duplicate id", `[{"id": "one", "expect": "a"}, {"id": "one", "expect": "b"}]`, story.ErrDuplicateStep},
+		{"wrong regex", `[{"expectRegex": "(red"}]`, nil},
+		{"wrong set", `[{"expect": "a", "set": ["score ++"]}]`, story.ErrExpression},
+		{"wrong branch set", `[{"branches": [{"set": ["score"]}]}]`, story.ErrExpression},
+		{"wrong branch when", `[{"branches": [{"when": "score >"}]}]`, story.ErrExpression},
+		{"set without name", `[{"expect": "a", "set": [" = 1"]}]`, story.ErrExpression},
+		{"when with wrong name", `[{"branches": [{"when": "a b > 1"}]}]`, story.ErrExpression},
+		{"step without responses", `[{"expect": "a", "fail": "b"}]`, nil},
+		{"branch without responses", `[{"branches": [{"expect": "a", "response": "b"}, {"expect": "c"}]}]`, nil},
+		{"two keyboards", `[{"expect": "a", "buttons": [["a"]], "inlineButtons": [["a"]]}]`, nil},
+		{"wrong media type", `[{"expect": "a", "response": {"type": "hologram", "url": "x"}}]`, story.ErrMediaType},
+		{"media without url", `[{"expect": "a", "responses": [{"type": "photo"}]}]`, nil},
+		{"wrong branch media type", `[{"branches": [{"responses": [{"type": "hologram"}]}]}]`, story.ErrMediaType},
+		{"unknown response field", `[{"expect": "a", "responses": [{"type": "photo", "link": "x"}]}]`, nil},
+		{"album with one item", `[{"expect": "a", "response": {"type": "album", "items": [{"type": "photo", "url": "x"}]}}]`, nil},
+		{"album with sticker", `[{"expect": "a", "response": {"type": "album", "items": [{"type": "photo", "url": "x"}, {"type": "sticker", "url": "y"}]}}]`, story.ErrMediaType},
+		{"album item without url", `[{"expect": "a", "response": {"type": "album", "items": [{"type": "photo", "url": "x"}, {"type": "photo"}]}}]`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := story.Load(strings.NewReader(tt.json))
+			require.Error(t, err)
+			if tt.want != nil {
+				assert.ErrorIs(t, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrorPosition(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		step  int
+		field string
+		line  int
+		col   int
+	}{
+		{"unknown field", "[\n  {\"expect\": \"a\"},\n  {\"expect\": \"b\",\n   \"respones\": [\"c\"]}\n]", 1, "respones", 4, 4},
+		{"unknown nested field", "[{\"expectGeo\": {\"lat\": 1, \"long\": 2}}]", 0, "long", 1, 27},
+		{"wrong type", "[\n{\"expect\": 5}\n]", 0, "expect", 2, 2},
+		{"syntax error", "[\n{\"expect\": \"a\"},\n{\"expect\" \"b\"}\n]", 1, "", 3, 11},
+		{"not an array", "5", -1, "", 1, 1},
+		{"step outside of array", "{\"expect\": \"a\"}", -1, "expect", 1, 2},
+		{"wrong story tolerance", "{\n  \"tolerance\": \"1\",\n  \"steps\": []\n}", -1, "tolerance", 2, 3},
+		{"step error in object", "{\"steps\": [\n{\"expect\": 5}\n]}", 0, "expect", 2, 2},
+		{"wrong goto", "[\n{\"expect\": \"a\", \"goto\": \"b\"}\n]", 0, "goto", 2, 17},
+		{"wrong regex", "[\n\n{\"expectRegex\": \"(\"}]", 0, "expectRegex", 3, 2},
+		{"field name in value", "[\n{\"expect\": \"goto\", \"goto\": \"b\"}\n]", 0, "goto", 2, 20},
+		{"nested field name in value", "[{\"response\": \"lat\", \"expectGeo\": {\"lat\": \"x\"}}]", 0, "expectGeo.lat", 1, 36},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := story.Load(strings.NewReader(tt.json))
+
+			var le *story.LoadError
+			require.ErrorAs(t, err, &le, "want LoadError")
+			assert.Equal(t, tt.step, le.Step, "want step index")
+			assert.Equal(t, tt.field, le.Field, "want field name")
+			assert.Equal(t, tt.line, le.Line, "want line")
+			assert.Equal(t, tt.col, le.Column, "want column")
+		})
+	}
+}
+
+func TestLoadErrorMessage(t *testing.T) {
+	_, err := story.Load(strings.NewReader("[\n  {\"respones\": [\"a\"]}\n]"))
+	assert.EqualError(t, err, `story: step 0, field "respones", line 2, column 4: unknown field`)
+}
+
+func TestStructuredResponses(t *testing.T) {
+	str, err := story.Load(strings.NewReader(`[
+		{
+			"expect": "listen",
+			"responses": [
+				"audio:http://example.com/short.mp3",
+				{"type": "audio", "url": "http://example.com/long.mp3", "caption": "part 2", "parseMode": "HTML"},
+				{"type": "text", "text": "photo: is just a word here"},
+				{"text": "<b>bold</b>", "parseMode": "HTML"},
+				{"text": "plain"}
+			],
+			"fail": "say listen"
+		}
+	]`))
+	require.NoError(t, err)
+	str.I18n(story.I18nMap{"ru": {"part 2": "часть 2"}})
+
+	rs := str.ResponsesTo(&story.State{Lang: "ru"}, "listen")
+	require.Len(t, rs, 5)
+
+	assert.Equal(t, "audio:http://example.com/short.mp3", rs[0].Text())
+	assert.Nil(t, rs[0].Media(), "want plain strings without media")
+
+	assert.Equal(t, "часть 2", rs[1].Text(), "want translated caption as text")
+	assert.Equal(t, &story.Media{Type: story.MediaAudio, URL: "http://example.com/long.mp3", ParseMode: "HTML"}, rs[1].Media())
+
+	assert.Equal(t, "photo: is just a word here", rs[2].Text())
+	assert.Equal(t, &story.Media{Type: story.MediaText}, rs[2].Media(), "want literal text kept as text")
+
+	assert.Equal(t, &story.Media{Type: story.MediaText, ParseMode: "HTML"}, rs[3].Media())
+	assert.Nil(t, rs[4].Media(), "want text object without anything else as plain text")
+
+	tr := str.I18nMap().Translate(rs, "en")
+	assert.Equal(t, "part 2", tr[1].Text())
+	assert.Equal(t, rs[1].Media(), tr[1].Media(), "want media kept in translation")
+}
+
+func TestAlbums(t *testing.T) {
+	str, err := story.Load(strings.NewReader(`[
+		{
+			"expect": "look",
+			"response": {
+				"type": "album",
+				"caption": "the room",
+				"items": [
+					{"type": "photo", "url": "http://example.com/1.jpg", "caption": "window"},
+					{"type": "video", "url": "http://example.com/2.mp4"}
+				]
+			},
+			"fail": "say look"
+		}
+	]`))
+	require.NoError(t, err)
+	str.I18n(story.I18nMap{"ru": {"the room": "комната", "window": "окно"}})
+
+	rs := str.ResponsesTo(&story.State{Lang: "ru"}, "look")
+	require.Len(t, rs, 1)
+	assert.Equal(t, "комната", rs[0].Text())
+	assert.Equal(t, &story.Media{Type: story.MediaAlbum, Items: []story.Media{
+		{Type: story.MediaPhoto, URL: "http://example.com/1.jpg", Caption: "окно"},
+		{Type: story.MediaVideo, URL: "http://example.com/2.mp4"},
+	}}, rs[0].Media(), "want album items with translated captions")
+
+	tr := str.I18nMap().Translate(rs, "en")
+	assert.Equal(t, "window", tr[0].Media().Items[0].Caption, "want item captions translated again")
+}
+
+func TestLoadStoryTolerance(t *testing.T) {
+	str, err := story.Load(strings.NewReader(`{
+		"tolerance": 1,
+		"steps": [
+			{"expect": "red rose", "response": "nice", "fail": "wrong"},
+			{"expect": "exact", "tolerance": 0, "response": "nice", "fail": "wrong"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, "nice", str.ResponsesWithLangStepTo(0, "", "red roze")[0].Text(), "want story tolerance used by steps")
+	assert.Equal(t, "wrong", str.ResponsesWithLangStepTo(1, "", "exakt")[0].Text(), "want step tolerance overriding story one")
+}
@@ -0,0 +1,28 @@
+package story
+
+// maxCallbackData is how many bytes Telegram allows in the data of an inline button, which is its label
+const maxCallbackData = 64
+
+// Keyboard is a set of buttons offered to the user to answer a step instead of typing.
+// Pressing a button sends its label as a message.
+type Keyboard struct {
+	// Inline buttons are attached to the message, otherwise they replace the keyboard of the user
+	Inline bool
+	Rows   [][]string
+}
+
+// translate returns the keyboard with labels translated to the language
+func (k *Keyboard) translate(m I18nMap, lang string) *Keyboard {
+	if k == nil {
+		return nil
+	}
+
+	rows := make([][]string, len(k.Rows))
+	for i, row := range k.Rows {
+		rows[i] = make([]string, len(row))
+		for j, l := range row {
+			rows[i][j] = m.Line(l, lang)
+		}
+	}
+	return &Keyboard{Inline: k.Inline, Rows: rows}
+}
@@ -0,0 +1,87 @@
+package story
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Prefixes of responses which are sent as a location pin instead of a text
+const (
+	// PrefixLocation starts a location response, like "location:43.257169,76.924515"
+	PrefixLocation = "location:"
+	// PrefixVenue starts a venue response, like "venue:43.257169,76.924515,Title,Address".
+	// The title cannot have commas.
+	PrefixVenue = "venue:"
+)
+
+var (
+	errCoordinates = errors.New("want latitude and longitude like 43.257169,76.924515")
+	errVenue       = errors.New("want title and address after coordinates")
+)
+
+// Venue is a location pin with a title and an address
+type Venue struct {
+	Latitude, Longitude float64
+	Title, Address      string
+}
+
+// ParseLocation parses the latitude and the longitude of a location response without its prefix
+func ParseLocation(s string) (float64, float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("location %q: %w", s, errCoordinates)
+	}
+
+	lat, lon, err := parseCoordinates(parts[0], parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("location %q: %w", s, err)
+	}
+	return lat, lon, nil
+}
+
+// ParseVenue parses a venue response without its prefix.
+// Everything after the title is the address, so it can have commas.
+func ParseVenue(s string) (Venue, error) {
+	parts := strings.SplitN(s, ",", 4)
+	if len(parts) < 4 {
+		return Venue{}, fmt.Errorf("venue %q: %w", s, errVenue)
+	}
+
+	lat, lon, err := parseCoordinates(parts[0], parts[1])
+	if err != nil {
+		return Venue{}, fmt.Errorf("venue %q: %w", s, err)
+	}
+	v := Venue{Latitude: lat, Longitude: lon, Title: strings.TrimSpace(parts[2]), Address: strings.TrimSpace(parts[3])}
+	if v.Title == "" || v.Address == "" {
+		return Venue{}, fmt.Errorf("venue %q: %w", s, errVenue)
+	}
+
+	return v, nil
+}
+
+func parseCoordinates(latText, lonText string) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latText), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, errCoordinates
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(lonText), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, errCoordinates
+	}
+
+	return lat, lon, nil
+}
+
+// checkPlace returns an error if the line is a location or a venue response which cannot be parsed
+func checkPlace(l string) error {
+	var err error
+	switch {
+	case strings.HasPrefix(l, PrefixLocation):
+		_, _, err = ParseLocation(l[len(PrefixLocation):])
+	case strings.HasPrefix(l, PrefixVenue):
+		_, err = ParseVenue(l[len(PrefixVenue):])
+	}
+	return err
+}
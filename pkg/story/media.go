@@ -0,0 +1,200 @@
+package story
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Types of structured responses
+const (
+	MediaText      = "text"
+	MediaAudio     = "audio"
+	MediaPhoto     = "photo"
+	MediaVoice     = "voice"
+	MediaVideo     = "video"
+	MediaVideoNote = "videonote"
+	MediaDocument  = "document"
+	MediaAnimation = "animation"
+	MediaSticker   = "sticker"
+	// MediaAlbum groups photos, videos, audios or documents into one message
+	MediaAlbum = "album"
+)
+
+// albumTypes are types of media which can be items of an album
+var albumTypes = []string{MediaPhoto, MediaVideo, MediaAudio, MediaDocument}
+
+// Telegram limits how many items an album can have
+const (
+	minAlbumItems = 2
+	maxAlbumItems = 10
+)
+
+// MediaTypes are all types a structured response can have
+var MediaTypes = []string{
+	MediaText, MediaAudio, MediaPhoto, MediaVoice, MediaVideo,
+	MediaVideoNote, MediaDocument, MediaAnimation, MediaSticker, MediaAlbum,
+}
+
+// ErrMediaType is returned when a structured response has an unknown type
+var ErrMediaType = errors.New("unknown media type")
+
+// Media describes how a response should be sent: its type, URL of the file and parse mode of the text.
+// The text of a media response is its caption, so it is translated like any other line.
+// An album has Items instead of URL, each of them with its own caption.
+// URL can also be a path to a local file or a file_id, it is up to the bot how to send it.
+type Media struct {
+	Type      string  `json:"type"`
+	URL       string  `json:"url,omitempty"`
+	ParseMode string  `json:"parseMode,omitempty"`
+	Caption   string  `json:"caption,omitempty"`
+	Items     []Media `json:"items,omitempty"`
+}
+
+// translate returns the media with captions of album items translated to the language
+func (m *Media) translate(i18n I18nMap, lang string) *Media {
+	if m == nil || len(m.Items) == 0 {
+		return m
+	}
+
+	t := *m
+	t.Items = make([]Media, len(m.Items))
+	for i, item := range m.Items {
+		item.Caption = i18n.Line(item.Caption, lang)
+		t.Items[i] = item
+	}
+	return &t
+}
+
+// JSONResponse is a response in JSON file. It is either a plain string, which is sent as it is,
+// or an object like {"type": "audio", "url": "http://example.com/audio.mp3", "caption": "listen", "parseMode": "HTML"}.
+// An album has items instead of url: {"type": "album", "items": [{"type": "photo", "url": "...", "caption": "..."}, ...]}.
+type JSONResponse struct {
+	Type      string         `json:"type,omitempty"`
+	Text      string         `json:"text,omitempty"`
+	URL       string         `json:"url,omitempty"`
+	Caption   string         `json:"caption,omitempty"`
+	ParseMode string         `json:"parseMode,omitempty"`
+	Items     []JSONResponse `json:"items,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Unknown fields of objects are not allowed.
+func (r *JSONResponse) UnmarshalJSON(b []byte) error {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '"' {
+		*r = JSONResponse{}
+		return json.Unmarshal(b, &r.Text)
+	}
+
+	// alias has no UnmarshalJSON, so it is decoded as a usual struct
+	type alias JSONResponse
+	return strictUnmarshal(b, (*alias)(r))
+}
+
+// MarshalJSON implements json.Marshaler. Plain text responses are written as strings.
+func (r JSONResponse) MarshalJSON() ([]byte, error) {
+	if r.media() == nil {
+		return json.Marshal(r.Text)
+	}
+
+	type alias JSONResponse
+	return json.Marshal(alias(r))
+}
+
+// captions returns captions of album items
+func (r JSONResponse) captions() []string {
+	var cs []string
+	for _, item := range r.Items {
+		if item.Caption != "" {
+			cs = append(cs, item.Caption)
+		}
+	}
+	return cs
+}
+
+// line returns the text of the response: the caption for media
+func (r JSONResponse) line() string {
+	if r.Type == "" || r.Type == MediaText {
+		return r.Text
+	}
+	return r.Caption
+}
+
+// media returns how the response should be sent, or nil if it is a plain text
+func (r JSONResponse) media() *Media {
+	if r.Type == "" && r.URL == "" && r.ParseMode == "" {
+		return nil
+	}
+
+	t := r.Type
+	if t == "" {
+		t = MediaText
+	}
+
+	m := &Media{Type: t, URL: r.URL, ParseMode: r.ParseMode}
+	for _, item := range r.Items {
+		m.Items = append(m.Items, Media{Type: item.Type, URL: item.URL, ParseMode: item.ParseMode, Caption: item.Caption})
+	}
+	return m
+}
+
+// check returns an error if the response has an unknown type or media without URL
+func (r JSONResponse) check() error {
+	m := r.media()
+	if m == nil {
+		return nil
+	}
+
+	known := false
+	for _, t := range MediaTypes {
+		known = known || t == m.Type
+	}
+	switch {
+	case !known:
+		return fmt.Errorf("%q: %w", m.Type, ErrMediaType)
+	case m.Type == MediaAlbum:
+		return checkAlbum(m)
+	case m.Type != MediaText && m.URL == "":
+		return fmt.Errorf("%q: %w", m.Type, errNoMediaURL)
+	}
+
+	return nil
+}
+
+// checkAlbum returns an error if the album has too few or too many items, or items which cannot be in an album
+func checkAlbum(m *Media) error {
+	if len(m.Items) < minAlbumItems || len(m.Items) > maxAlbumItems {
+		return fmt.Errorf("album has %d items: %w", len(m.Items), errAlbumItems)
+	}
+
+	for _, item := range m.Items {
+		allowed := false
+		for _, t := range albumTypes {
+			allowed = allowed || t == item.Type
+		}
+		switch {
+		case !allowed:
+			return fmt.Errorf("album item %q: %w", item.Type, ErrMediaType)
+		case item.URL == "":
+			return fmt.Errorf("album item %q: %w", item.Type, errNoMediaURL)
+		}
+	}
+
+	return nil
+}
+
+// jsonResponses converts JSON responses to lines of the story and media of the lines by their indexes
+func jsonResponses(rs []JSONResponse) ([]string, map[int]*Media) {
+	lines := make([]string, len(rs))
+	var media map[int]*Media
+	for i, r := range rs {
+		lines[i] = r.line()
+		if m := r.media(); m != nil {
+			if media == nil {
+				media = make(map[int]*Media)
+			}
+			media[i] = m
+		}
+	}
+	return lines, media
+}
@@ -3,6 +3,7 @@ package story
 import (
 	"fmt"
 	"math"
+	"regexp"
 
 	"github.com/asahnoln/mesproc/pkg/store"
 )
@@ -11,18 +12,35 @@ import (
 // It holds information on what message it expects from the user to advance the story
 // and how it would respond to proper or a wrong message.
 type Step struct {
-	expectation string
-	responses   []string
-	failMessage string
-	isGeo       bool
-	geoExp      [3]float64
-	store       store.Step
-	additional  map[int]map[string]interface{}
+	id           string
+	expectation  string
+	anyOf        []string
+	pattern      string
+	regex        *regexp.Regexp
+	tolerance    int
+	responses    []string
+	failMessage  string
+	hints        []string
+	advanceAfter int
+	isGeo        bool
+	geoExp       [3]float64
+	store        store.Step
+	additional   map[int]map[string]interface{}
+	branches     []*Branch
+	target       string
+	sets         []string
+	keyboard     *Keyboard
+	media        map[int]*Media
 }
 
 // NewStep returns a new Step
 func NewStep() *Step {
-	return &Step{}
+	return &Step{tolerance: -1}
+}
+
+// ID returns the name of the Step, which other steps can use to jump to it.
+func (s *Step) ID() string {
+	return s.id
 }
 
 // Expectation returns expected message to advance the story.
@@ -30,6 +48,12 @@ func (s *Step) Expectation() string {
 	return s.expectation
 }
 
+// expects reports whether the Step has an expectation of its own.
+// A step with only branches expects nothing, so it is met only by its branches.
+func (s *Step) expects() bool {
+	return s.expectation != "" || s.anyOf != nil || s.regex != nil || s.isGeo || s.store != nil
+}
+
 // Response returns response of the Step
 func (s *Step) Response() string {
 	return s.responses[0]
@@ -45,24 +69,121 @@ func (s *Step) FailMessage() string {
 	return s.failMessage
 }
 
+// Branches returns alternative expectations of the Step
+func (s *Step) Branches() []*Branch {
+	return s.branches
+}
+
+// As names the Step, so branches of other steps could lead to it
+func (s *Step) As(id string) *Step {
+	s.id = id
+	return s
+}
+
+// Target returns ID of the step the story goes to after the Step instead of the next one
+func (s *Step) Target() string {
+	return s.target
+}
+
+// Goto sets ID of the step the story goes to after the Step.
+// For commands and unordered steps it makes the user jump to the step.
+func (s *Step) Goto(id string) *Step {
+	s.target = id
+	return s
+}
+
+// Set sets assignments of story variables, like "visited = true" or "score += 1",
+// which are applied when the Step is passed
+func (s *Step) Set(exprs ...string) *Step {
+	s.sets = append(s.sets, exprs...)
+	return s
+}
+
 // Expect sets expected message for the Step
 func (s *Step) Expect(e string) *Step {
 	s.expectation = e
 	return s
 }
 
+// ExpectAny sets several expected messages for the Step, any of them advances the story
+func (s *Step) ExpectAny(e ...string) *Step {
+	s.anyOf = e
+	return s
+}
+
+// ExpectRegex sets a regular expression the message should match to advance the story.
+// Matching is case-insensitive. It panics if the expression cannot be parsed.
+func (s *Step) ExpectRegex(pattern string) *Step {
+	s.pattern = pattern
+	s.regex = compileExpectation(pattern)
+	return s
+}
+
+// Tolerate sets how many mistyped letters are accepted in the message for the Step,
+// overriding the default tolerance of the story
+func (s *Step) Tolerate(n int) *Step {
+	s.tolerance = n
+	return s
+}
+
+// Buttons sets rows of reply buttons offered to the user when the story comes to the Step
+func (s *Step) Buttons(rows ...[]string) *Step {
+	s.keyboard = &Keyboard{Rows: rows}
+	return s
+}
+
+// InlineButtons sets rows of buttons attached to the message with which the story comes to the Step
+func (s *Step) InlineButtons(rows ...[]string) *Step {
+	s.keyboard = &Keyboard{Inline: true, Rows: rows}
+	return s
+}
+
+// Keyboard returns buttons offered to the user at the Step, or nil if there are none
+func (s *Step) Keyboard() *Keyboard {
+	return s.keyboard
+}
+
 // Respond sets response for the right message
 func (s *Step) Respond(r ...string) *Step {
 	s.responses = r
 	return s
 }
 
+// Media makes the response with the index be sent as media, its text becomes the caption.
+// Media with MediaText type only sets the parse mode of the text.
+func (s *Step) Media(i int, m Media) *Step {
+	if s.media == nil {
+		s.media = make(map[int]*Media)
+	}
+
+	s.media[i] = &m
+	return s
+}
+
 // Fail sets a fail message for the step which is returned when given input is not what expected in the step.
 func (s *Step) Fail(e string) *Step {
 	s.failMessage = e
 	return s
 }
 
+// Hint sets fail messages given one by one on consecutive failures instead of the fail message.
+// The last hint is repeated when there are more failures than hints.
+func (s *Step) Hint(h ...string) *Step {
+	s.hints = h
+	return s
+}
+
+// Hints returns fail messages given one by one on consecutive failures
+func (s *Step) Hints() []string {
+	return s.hints
+}
+
+// AdvanceAfter makes the story go on after given count of consecutive failures
+func (s *Step) AdvanceAfter(fails int) *Step {
+	s.advanceAfter = fails
+	return s
+}
+
 // ExpectGeo sets expectation for the step to be a geo location instead of plain text
 func (s *Step) ExpectGeo(lat, lon float64, precision float64) *Step {
 	s.isGeo = true
@@ -76,6 +197,12 @@ func (s *Step) ExpectSave(store store.Step) *Step {
 	return s
 }
 
+// Branch adds alternative expectations to the Step, each leading to its own step
+func (s *Step) Branch(b ...*Branch) *Step {
+	s.branches = append(s.branches, b...)
+	return s
+}
+
 func (s *Step) Additional(step int, field string, value interface{}) *Step {
 	if s.additional == nil {
 		s.additional = make(map[int]map[string]interface{})
@@ -88,6 +215,26 @@ func (s *Step) Additional(step int, field string, value interface{}) *Step {
 	return s
 }
 
+// hint returns a fail message for the given attempt, starting from 1
+func (s *Step) hint(attempt int) string {
+	if len(s.hints) == 0 {
+		return s.failMessage
+	}
+	if attempt > len(s.hints) {
+		attempt = len(s.hints)
+	}
+
+	return s.hints[attempt-1]
+}
+
+func compileExpectation(pattern string) *regexp.Regexp {
+	return regexp.MustCompile(expectationRegex(pattern))
+}
+
+func expectationRegex(pattern string) string {
+	return "(?i)" + fixRussianYo(pattern)
+}
+
 func (s *Step) checkGeo(m string) bool {
 	var lat, lon float64
 	fmt.Sscanf(m, "%f,%f", &lat, &lon)
@@ -31,6 +31,95 @@ func TestExpectGeoLocation(t *testing.T) {
 	assert.Equal(t, stp.FailMessage(), str.ResponsesWithLangStepTo(0, "", "43.257248572900004,76.92567261243957")[0].Text(), "want fail geo response when far")
 }
 
+func TestExpectAny(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().ExpectAny("knit", "knitting").Respond("let's knit").Fail("what do we do?")).
+		I18n(story.I18nMap{
+			"ru": {
+				"knit": "вязать",
+			},
+		})
+
+	assert.Equal(t, "let's knit", str.ResponsesWithLangStepTo(0, "", "Knitting")[0].Text(), "want response to any of expectations")
+	assert.Equal(t, "let's knit", str.ResponsesWithLangStepTo(0, "ru", "вязать")[0].Text(), "want response to translated expectation")
+	assert.Equal(t, "what do we do?", str.ResponsesWithLangStepTo(0, "", "knitter")[0].Text(), "want fail response")
+}
+
+func TestExpectRegex(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().ExpectRegex("^(the )?red (door|gate)$").Respond("it opens").Fail("which one?")).
+		I18n(story.I18nMap{
+			"ru": {
+				"^(the )?red (door|gate)$": "^красн(ая|ые) (дверь|ворота)$",
+			},
+			"kk": {
+				"^(the )?red (door|gate)$": "^(broken$",
+			},
+		})
+
+	tests := []struct {
+		message string
+		lang    string
+		want    string
+	}{
+		{"red door", "", "it opens"},
+		{"The Red Gate", "", "it opens"},
+		{"a red door", "", "which one?"},
+		{"красные ворота", "ru", "it opens"},
+		{"red door", "ru", "which one?"},
+		{"red door", "kk", "which one?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			assert.Equal(t, tt.want, str.ResponsesWithLangStepTo(0, tt.lang, tt.message)[0].Text())
+		})
+	}
+
+	assert.Panics(t, func() { story.NewStep().ExpectRegex("(") }, "want panic on wrong regular expression")
+}
+
+func TestHints(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().Expect("rose").Respond("right").Fail("wrong").
+			Hint("think about colour", "it's something red", "the answer is 'rose'")).
+		Add(story.NewStep().Expect("tulip").Respond("right").Fail("wrong"))
+
+	tests := []struct {
+		step, fails int
+		want        string
+	}{
+		{0, 0, "think about colour"},
+		{0, 1, "it's something red"},
+		{0, 2, "the answer is 'rose'"},
+		{0, 5, "the answer is 'rose'"},
+		{1, 3, "wrong"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			rs := str.ResponsesTo(&story.State{Step: tt.step, Fails: tt.fails}, "daisy")
+			assert.Equal(t, tt.want, rs[0].Text(), "want hint for the attempt")
+			assert.True(t, rs[0].Failed(), "want failed response")
+		})
+	}
+}
+
+func TestAdvanceAfterFails(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().Expect("rose").Respond("moving on").Hint("think", "red").AdvanceAfter(3)).
+		Add(story.NewStep().Expect("tulip").Respond("right").Fail("wrong"))
+
+	rs := str.ResponsesTo(&story.State{Fails: 1}, "daisy")
+	assert.Equal(t, "red", rs[0].Text())
+	assert.Equal(t, 0, rs[0].Next(), "want to stay before enough fails")
+
+	rs = str.ResponsesTo(&story.State{Fails: 2}, "daisy")
+	assert.Equal(t, "moving on", rs[0].Text(), "want step responses on advancing")
+	assert.True(t, rs[0].Failed(), "want failed response")
+	assert.Equal(t, 1, rs[0].Next(), "want to advance after enough fails")
+}
+
 // TODO: Merge with error test
 func TestSaveExpectation(t *testing.T) {
 	store := &stubStore{}
@@ -1,7 +1,19 @@
 package story
 
 import (
+	"encoding/json"
+	"errors"
+	"regexp"
 	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// ErrUnknownStep is returned when a step refers to an ID which no step has
+	ErrUnknownStep = errors.New("unknown step")
+	// ErrDuplicateStep is returned when several steps have the same ID
+	ErrDuplicateStep = errors.New("duplicate step")
 )
 
 // Response is a struct which story returns in response to a message
@@ -10,6 +22,12 @@ type Response struct {
 
 	original, text, lang string
 	shouldAdvance        bool
+	failed               bool
+	next                 int
+	// keyboard is translated, buttons are kept as they are in the story to translate them again
+	keyboard, buttons *Keyboard
+	// media is translated, sourceMedia is kept as it is in the story to translate it again
+	media, sourceMedia *Media
 }
 
 // Text returns text of response
@@ -22,18 +40,104 @@ func (r Response) ShouldAdvance() bool {
 	return r.shouldAdvance
 }
 
+// Failed returns whether the message didn't meet the expectation of the step
+func (r Response) Failed() bool {
+	return r.failed
+}
+
+// Next returns the index of the step the story should be at after this response
+func (r Response) Next() int {
+	return r.next
+}
+
 // Lang returns the language of the response
 func (r Response) Lang() string {
 	return r.lang
 }
 
+// Media returns how the response should be sent, or nil if it is a plain text.
+// The text of a media response is its caption.
+func (r Response) Media() *Media {
+	return r.media
+}
+
+// Keyboard returns translated buttons the user can answer with, or nil if there are none.
+// Only the last response to a message can have buttons.
+func (r Response) Keyboard() *Keyboard {
+	return r.keyboard
+}
+
+// jsonResponse is a Response as it is stored in JSON
+type jsonResponse struct {
+	Text          string                 `json:"text"`
+	Original      string                 `json:"original,omitempty"`
+	Lang          string                 `json:"lang,omitempty"`
+	ShouldAdvance bool                   `json:"shouldAdvance,omitempty"`
+	Failed        bool                   `json:"failed,omitempty"`
+	Next          int                    `json:"next"`
+	Additional    map[string]interface{} `json:"additional,omitempty"`
+	Keyboard      *Keyboard              `json:"keyboard,omitempty"`
+	Buttons       *Keyboard              `json:"buttons,omitempty"`
+	Media         *Media                 `json:"media,omitempty"`
+	SourceMedia   *Media                 `json:"sourceMedia,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler, so responses can be stored and sent later
+func (r Response) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonResponse{
+		Text:          r.text,
+		Original:      r.original,
+		Lang:          r.lang,
+		ShouldAdvance: r.shouldAdvance,
+		Failed:        r.failed,
+		Next:          r.next,
+		Additional:    r.Additional,
+		Keyboard:      r.keyboard,
+		Buttons:       r.buttons,
+		Media:         r.media,
+		SourceMedia:   r.sourceMedia,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// Additional "time" is restored as time.Duration, other additional values are decoded as usual JSON values.
+func (r *Response) UnmarshalJSON(b []byte) error {
+	var j jsonResponse
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+
+	if t, ok := j.Additional["time"].(float64); ok {
+		j.Additional["time"] = time.Duration(t)
+	}
+
+	*r = Response{
+		Additional:    j.Additional,
+		original:      j.Original,
+		text:          j.Text,
+		lang:          j.Lang,
+		shouldAdvance: j.ShouldAdvance,
+		failed:        j.Failed,
+		next:          j.Next,
+		keyboard:      j.Keyboard,
+		buttons:       j.Buttons,
+		media:         j.Media,
+		sourceMedia:   j.SourceMedia,
+	}
+	return nil
+}
+
 // Story holds information on the current story.
 // It has steps and i18n.
 type Story struct {
 	steps     []*Step
 	cmds      map[string]*Step
 	unordered map[string]*Step
+	ids       map[string]int
 	i18n      I18nMap
+	tolerance int
+	// regexes are translated expectations of steps compiled by translated patterns
+	regexes map[string]*regexp.Regexp
 }
 
 // New creates a new Story
@@ -41,12 +145,18 @@ func New() *Story {
 	return &Story{
 		cmds:      make(map[string]*Step),
 		unordered: make(map[string]*Step),
+		ids:       make(map[string]int),
+		regexes:   make(map[string]*regexp.Regexp),
 	}
 }
 
 // Add adds a Step to the Story
 func (s *Story) Add(step *Step) *Story {
+	if step.ID() != "" {
+		s.ids[step.ID()] = len(s.steps)
+	}
 	s.steps = append(s.steps, step)
+	s.compileTranslations(step)
 	return s
 }
 
@@ -63,48 +173,115 @@ func (s *Story) AddUnordered(step *Step) *Story {
 
 // ResponsesWithLangStepTo return multiple responses from a step with ones
 func (s *Story) ResponsesWithLangStepTo(stp int, lang string, m string) []Response {
+	return s.ResponsesTo(&State{Step: stp, Lang: lang}, m)
+}
+
+// ResponsesTo returns responses to the message for a user in the given state.
+// Story variables of the state are updated by the passed step.
+func (s *Story) ResponsesTo(st *State, m string) []Response {
+	if st.Vars == nil {
+		st.Vars = make(Vars)
+	}
 	m = fixRussianYo(m)
 
-	rs, l, ok := s.parseAndRespond(stp, lang, m)
-	result := make([]Response, len(rs))
-	for i, r := range rs {
+	o := s.parseAndRespond(st, m)
+	result := make([]Response, len(o.responses))
+	for i, r := range o.responses {
 		result[i] = Response{
 			original:      r,
-			text:          s.i18n.Line(r, l),
-			shouldAdvance: ok,
-			lang:          l,
+			text:          s.i18n.Line(r, o.lang),
+			shouldAdvance: o.advance,
+			failed:        o.failed,
+			next:          o.next,
+			lang:          o.lang,
+			media:         o.media[i].translate(s.i18n, o.lang),
+			sourceMedia:   o.media[i],
+			Additional:    o.additional[i],
 		}
+	}
 
-		if len(s.steps) > 0 {
-			result[i].Additional = s.steps[s.rotateStep(stp)].additional[i]
-		}
+	// Buttons of the step the user comes to are offered with the last response
+	if n := len(result); n > 0 && len(s.steps) > 0 {
+		k := s.steps[s.rotateStep(o.next)].keyboard
+		result[n-1].buttons = k
+		result[n-1].keyboard = k.translate(s.i18n, o.lang)
 	}
 	return result
 }
 
+// outcome is what the story figured out in response to a message
+type outcome struct {
+	responses       []string
+	media           map[int]*Media
+	additional      map[int]map[string]interface{}
+	lang            string
+	next            int
+	advance, failed bool
+}
+
 func fixRussianYo(m string) string {
 	return strings.ReplaceAll(m, "ё", "е")
 }
 
-func (s *Story) parseAndRespond(stp int, lang string, m string) ([]string, string, bool) {
+func (s *Story) parseAndRespond(st *State, m string) outcome {
+	lang := st.Lang
 	if lang == "" {
 		lang = "en"
 	}
 
-	if r, l, ok := s.parseUnordered(m); ok {
+	if stp, r, l, ok := s.parseUnordered(m); ok {
 		if l != "" {
 			lang = l
 		}
-		return r, lang, false
+		o := outcome{responses: r, lang: lang, next: st.Step}
+		if stp == nil {
+			return o
+		}
+
+		o.media, o.additional = stp.media, stp.additional
+		st.Vars.Set(stp.sets...)
+		if i, ok := s.ids[stp.target]; ok {
+			o.next, o.advance = i, true
+		}
+		return o
 	}
 
-	r, ok := s.stepResponsesOrFail(m, lang, s.rotateStep(stp))
-	return r, lang, ok
+	o := s.stepResponsesOrFail(m, lang, s.rotateStep(st.Step), st)
+	o.lang = lang
+	return o
 }
 
 // I18n sets i18n localzation for the story
 func (s *Story) I18n(i I18nMap) *Story {
 	s.i18n = i
+	s.regexes = make(map[string]*regexp.Regexp)
+	for _, stp := range s.steps {
+		s.compileTranslations(stp)
+	}
+	return s
+}
+
+// compileTranslations compiles translated regular expressions of the step once,
+// so they are not compiled on every message. Wrong translations are kept as nil, Validate reports them.
+func (s *Story) compileTranslations(stp *Step) {
+	if stp.regex == nil {
+		return
+	}
+
+	for _, tr := range s.i18n {
+		pattern, ok := tr[stp.pattern]
+		if !ok {
+			continue
+		}
+		re, _ := regexp.Compile(expectationRegex(pattern))
+		s.regexes[pattern] = re
+	}
+}
+
+// Tolerate sets default tolerance of the story: how many mistyped letters are accepted in messages.
+// Steps can override it.
+func (s *Story) Tolerate(n int) *Story {
+	s.tolerance = n
 	return s
 }
 
@@ -112,37 +289,152 @@ func (s *Story) I18nMap() I18nMap {
 	return s.i18n
 }
 
+// StepIndex returns the index of the step the story is at for the given step,
+// the story starts over after the last step
+func (s *Story) StepIndex(stp int) int {
+	if len(s.steps) == 0 {
+		return stp
+	}
+	return s.rotateStep(stp)
+}
+
 func (s *Story) rotateStep(stp int) int {
 	return stp % len(s.steps)
 }
 
-func (s *Story) stepResponsesOrFail(m, lang string, stp int) ([]string, bool) {
+func (s *Story) stepResponsesOrFail(m, lang string, stp int, st *State) outcome {
 	step := s.steps[stp]
 
-	if s.isExpectationCorrect(m, lang, step) {
-		return step.Responses(), true
+	// Exact matches are looked for in the step and all its branches first,
+	// so a mistyped match of a branch never wins over an exact match of the step or a later branch
+	if o, ok := s.matchStep(m, lang, stp, st, 0); ok {
+		return o
+	}
+	if tolerance := s.toleranceOf(step); tolerance > 0 {
+		if o, ok := s.matchStep(m, lang, stp, st, tolerance); ok {
+			return o
+		}
 	}
 
-	return []string{step.failMessage}, false
+	attempt := st.Fails + 1
+	if step.advanceAfter > 0 && attempt >= step.advanceAfter {
+		return outcome{responses: step.Responses(), media: step.media, additional: step.additional, next: s.target(step.target, stp), advance: true, failed: true}
+	}
+
+	return outcome{responses: []string{step.hint(attempt)}, next: stp, failed: true}
 }
 
-func (s *Story) isExpectationCorrect(m, lang string, stp *Step) bool {
+// matchStep returns the outcome of the branch or the step itself met by the message within the tolerance
+func (s *Story) matchStep(m, lang string, stp int, st *State, tolerance int) (outcome, bool) {
+	step := s.steps[stp]
+	// A message without text, like a sticker, would meet the empty expectation of a step with only branches
+	correct := (step.expects() || len(step.branches) == 0) && s.isExpectationCorrect(m, lang, step, tolerance)
+
+	for _, b := range step.branches {
+		if !st.Vars.Holds(b.condition) {
+			continue
+		}
+
+		if b.expectation != "" && s.isTextCorrect(m, lang, b.expectation, tolerance) ||
+			b.expectation == "" && correct {
+			st.Vars.Set(b.sets...)
+			return outcome{responses: b.responsesOr(step), media: b.mediaOr(step), additional: b.additionalOr(step), next: s.target(b.targetOr(step), stp), advance: true}, true
+		}
+	}
+
+	if correct {
+		st.Vars.Set(step.sets...)
+		return outcome{responses: step.Responses(), media: step.media, additional: step.additional, next: s.target(step.target, stp), advance: true}, true
+	}
+
+	return outcome{}, false
+}
+
+// target returns the index of the step with given id.
+// If there is no such step, the story just goes on to the step after the current one.
+func (s *Story) target(id string, stp int) int {
+	if i, ok := s.ids[id]; ok {
+		return i
+	}
+
+	return stp + 1
+}
+
+// isExpectationCorrect returns whether the message meets the expectation of the step.
+// Only texts can be mistyped, other expectations are met only when tolerance is 0,
+// so the message is saved once.
+func (s *Story) isExpectationCorrect(m, lang string, stp *Step, tolerance int) bool {
+	if tolerance > 0 && (stp.store != nil || stp.isGeo || stp.regex != nil) {
+		return false
+	}
+
 	if stp.store != nil {
 		err := stp.store.Save(m)
 		return err == nil
 	}
 
-	if !stp.isGeo {
-		return strings.EqualFold(
-			fixRussianYo(s.i18n.Line(stp.expectation, lang)),
-			m,
-		)
+	switch {
+	case stp.isGeo:
+		return stp.checkGeo(m)
+	case stp.regex != nil:
+		return s.isRegexCorrect(m, lang, stp)
+	case stp.anyOf != nil:
+		for _, e := range stp.anyOf {
+			if s.isTextCorrect(m, lang, e, tolerance) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return s.isTextCorrect(m, lang, stp.expectation, tolerance)
+}
+
+// isRegexCorrect matches the message against the regular expression of the step.
+// The expression can be translated with i18n like any other line.
+// A translation which is not a proper expression matches nothing.
+func (s *Story) isRegexCorrect(m, lang string, stp *Step) bool {
+	pattern := s.i18n.Line(stp.pattern, lang)
+	if pattern == stp.pattern {
+		return stp.regex.MatchString(m)
+	}
+
+	re := s.regexes[pattern]
+	return re != nil && re.MatchString(m)
+}
+
+// isTextCorrect compares the message with the translated expectation.
+// If tolerance is set, the message is accepted when it is within the tolerated edit distance
+// from the expectation after normalization. The distance is kept below the length of the expectation,
+// otherwise any word of its length would do, and a message without words is never accepted.
+func (s *Story) isTextCorrect(m, lang, expectation string, tolerance int) bool {
+	e := fixRussianYo(s.i18n.Line(expectation, lang))
+	if strings.EqualFold(e, m) {
+		return true
+	}
+	if tolerance <= 0 {
+		return false
+	}
+
+	ne, nm := normalize(e), normalize(m)
+	if nm == "" {
+		return false
+	}
+	if n := utf8.RuneCountInString(ne); tolerance >= n {
+		tolerance = n - 1
+	}
+	return editDistance(ne, nm) <= tolerance
+}
+
+func (s *Story) toleranceOf(stp *Step) int {
+	if stp.tolerance < 0 {
+		return s.tolerance
 	}
 
-	return stp.checkGeo(m)
+	return stp.tolerance
 }
 
-func (s *Story) parseUnordered(m string) ([]string, string, bool) {
+func (s *Story) parseUnordered(m string) (*Step, []string, string, bool) {
 	m = strings.ToLower(m)
 	lookUp := s.unordered
 
@@ -152,14 +444,14 @@ func (s *Story) parseUnordered(m string) ([]string, string, bool) {
 	}
 
 	if r, lang, ok := s.processI18nCommand(m); ok {
-		return []string{r}, lang, true
+		return nil, []string{r}, lang, true
 	}
 
 	if stp, ok := lookUp[m]; ok {
-		return stp.Responses(), "", true
+		return stp, stp.Responses(), "", true
 	}
 
-	return nil, "", false
+	return nil, nil, "", false
 }
 
 func (s *Story) processI18nCommand(c string) (string, string, bool) {
@@ -1,10 +1,14 @@
 package story_test
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/asahnoln/mesproc/pkg/story"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSteps(t *testing.T) {
@@ -87,10 +91,12 @@ func TestRespondToSpecificStep(t *testing.T) {
 
 	t.Run("successful response should advance the step", func(t *testing.T) {
 		assert.True(t, str.ResponsesWithLangStepTo(4, "", "step 1")[0].ShouldAdvance(), "want ShouldAdvance() = true")
+		assert.Equal(t, 1, str.ResponsesWithLangStepTo(4, "", "step 1")[0].Next(), "want next step")
 	})
 
 	t.Run("wrong expectation must not advance the step", func(t *testing.T) {
 		assert.False(t, str.ResponsesWithLangStepTo(5, "", "step 1")[0].ShouldAdvance(), "want ShouldAdvance() = false")
+		assert.Equal(t, 1, str.ResponsesWithLangStepTo(5, "", "step 1")[0].Next(), "want the same step")
 	})
 }
 
@@ -136,6 +142,74 @@ func TestSeveralResponses(t *testing.T) {
 	assert.Equal(t, "второе сообщение", rs[1].Text(), "want second message")
 }
 
+func TestTolerance(t *testing.T) {
+	str := story.New().
+		Tolerate(1).
+		Add(story.NewStep().Expect("red rose").Respond("nice").Fail("wrong")).
+		Add(story.NewStep().Expect("knitting").Tolerate(2).Respond("nice").Fail("wrong")).
+		Add(story.NewStep().Expect("exact").Tolerate(0).Respond("nice").Fail("wrong")).
+		Add(story.NewStep().ExpectAny("scarf", "hat").Respond("nice").Fail("wrong")).
+		Add(story.NewStep().Expect("ёлка").Respond("nice").Fail("wrong")).
+		Add(story.NewStep().Expect("ok").Tolerate(2).Respond("nice").Fail("wrong"))
+
+	tests := []struct {
+		step    int
+		message string
+		want    string
+	}{
+		{0, "red rose", "nice"},
+		{0, "Red  rose!", "nice"},
+		{0, "red roze", "nice"},
+		{0, "rad roze", "wrong"},
+		{1, "kniting", "nice"},
+		{1, "knittign", "nice"},
+		{1, "knot", "wrong"},
+		{2, "exakt", "wrong"},
+		{3, "hta", "wrong"},
+		{3, "scarv", "nice"},
+		{4, "елкa", "nice"},
+		{4, "ёлки", "nice"},
+		{5, "oj", "nice"},
+		{5, "no", "wrong"},
+		{5, "", "wrong"},
+		{5, "?!", "wrong"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			assert.Equal(t, tt.want, str.ResponsesWithLangStepTo(tt.step, "", tt.message)[0].Text())
+		})
+	}
+}
+
+func TestToleranceExactMatchFirst(t *testing.T) {
+	str := story.New().
+		Tolerate(1).
+		Add(story.NewStep().Expect("cat").Respond("meow").Fail("wrong").
+			Branch(
+				story.NewBranch().Expect("car").Respond("vroom"),
+				story.NewBranch().Expect("bar").Respond("cheers"),
+				story.NewBranch().Expect("bat").Respond("flap"),
+			))
+
+	tests := []struct {
+		message, want string
+	}{
+		{"cat", "meow"},
+		{"car", "vroom"},
+		{"bat", "flap"},
+		{"cot", "meow"},
+		{"cas", "vroom"},
+		{"dog", "wrong"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			assert.Equal(t, tt.want, str.ResponsesWithLangStepTo(0, "", tt.message)[0].Text(), "want exact match before mistyped ones")
+		})
+	}
+}
+
 func TestUnorderedCaseInsensitiveSteps(t *testing.T) {
 	str := story.New().
 		Add(story.NewStep().Expect("ordered").Respond("not step I want").Fail("ordered expectation fail")).
@@ -166,3 +240,231 @@ func TestYeAndYoSimilarInRussian(t *testing.T) {
 		assert.Equal(t, "nice", rs[0].Text(), "want proper response to ye message with yo expectation")
 	})
 }
+
+func TestBranches(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().
+			Expect("straight").
+			Respond("going straight").
+			Fail("left, right or straight?").
+			Branch(
+				story.NewBranch().Expect("left").Goto("garden").Respond("going to the garden"),
+				story.NewBranch().Expect("right").Goto("cellar"),
+			)).
+		Add(story.NewStep().Expect("look").Respond("a road").Fail("still on the road")).
+		Add(story.NewStep().As("garden").Expect("look").Respond("flowers").Fail("still in the garden")).
+		Add(story.NewStep().As("cellar").Expect("look").Respond("darkness").Fail("still in the cellar")).
+		I18n(story.I18nMap{
+			"ru": {
+				"left": "налево",
+			},
+		})
+
+	tests := []struct {
+		message string
+		lang    string
+		want    string
+		next    int
+	}{
+		{"straight", "", "going straight", 1},
+		{"left", "", "going to the garden", 2},
+		{"налево", "ru", "going to the garden", 2},
+		{"right", "", "going straight", 3},
+		{"up", "", "left, right or straight?", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			rs := str.ResponsesWithLangStepTo(0, tt.lang, tt.message)
+			assert.Equal(t, tt.want, rs[0].Text(), "want branch response")
+			assert.Equal(t, tt.next, rs[0].Next(), "want next step of the branch")
+		})
+	}
+
+	assert.Equal(t, "darkness", str.ResponsesWithLangStepTo(3, "", "look")[0].Text(), "want step after branch")
+}
+
+func TestBranchToUnknownStepAdvances(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().Branch(story.NewBranch().Expect("go").Goto("nowhere")).Respond("went")).
+		Add(story.NewStep().Expect("next").Respond("done"))
+
+	assert.Equal(t, 1, str.ResponsesWithLangStepTo(0, "", "go")[0].Next(), "want next step when branch target is unknown")
+}
+
+func TestEmptyMessageAtBranchesOnlyStep(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().
+			Respond("going on").
+			Fail("left or right?").
+			Branch(
+				story.NewBranch().Expect("left").Respond("going left"),
+				story.NewBranch().Expect("right").Respond("going right"),
+			)).
+		Add(story.NewStep().Expect("look").Respond("a road").Fail("still on the road"))
+
+	// Stickers, photos and voice notes come without text
+	rs := str.ResponsesWithLangStepTo(0, "", "")
+	assert.Equal(t, "left or right?", rs[0].Text(), "want empty message to fail the branch choice")
+	assert.Equal(t, 0, rs[0].Next())
+
+	assert.Equal(t, "going left", str.ResponsesWithLangStepTo(0, "", "left")[0].Text())
+}
+
+func TestGoto(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().Expect("skip").Respond("skipping").Fail("want skip").Goto("end")).
+		Add(story.NewStep().Expect("middle").Respond("middle").Fail("want middle")).
+		Add(story.NewStep().As("end").Expect("end").Respond("the end").Fail("want end")).
+		AddCommand(story.NewStep().Expect("chapter2").Respond("jumping to the middle").Goto("nowhere")).
+		AddCommand(story.NewStep().Expect("end").Respond("jumping to the end").Goto("end")).
+		AddUnordered(story.NewStep().Expect("finale").Respond("the finale").Goto("end"))
+
+	t.Run("step goto", func(t *testing.T) {
+		rs := str.ResponsesWithLangStepTo(0, "", "skip")
+		assert.Equal(t, 2, rs[0].Next(), "want jump to named step")
+	})
+
+	t.Run("command goto", func(t *testing.T) {
+		rs := str.ResponsesWithLangStepTo(1, "", "/end")
+		assert.Equal(t, "jumping to the end", rs[0].Text())
+		assert.True(t, rs[0].ShouldAdvance(), "want command to move the story")
+		assert.Equal(t, 2, rs[0].Next(), "want command jump to named step")
+	})
+
+	t.Run("unordered goto", func(t *testing.T) {
+		assert.Equal(t, 2, str.ResponsesWithLangStepTo(0, "", "Finale")[0].Next(), "want unordered jump to named step")
+	})
+
+	t.Run("unknown goto stays", func(t *testing.T) {
+		rs := str.ResponsesWithLangStepTo(1, "", "/chapter2")
+		assert.False(t, rs[0].ShouldAdvance())
+		assert.Equal(t, 1, rs[0].Next(), "want the same step when target is unknown")
+	})
+}
+
+func TestConditionalBranches(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().
+			Fail("left or right?").
+			Branch(
+				story.NewBranch().Expect("left").Set("visited_garden = true", "score += 1").Respond("garden"),
+				story.NewBranch().Expect("right").Set("score += 2").Respond("cellar"),
+			)).
+		Add(story.NewStep().
+			Expect("open").
+			Respond("bad ending").
+			Fail("open the door").
+			Branch(
+				story.NewBranch().When("visited_garden").Respond("garden ending"),
+				story.NewBranch().When("score >= 2").Respond("cellar ending"),
+			)).
+		AddUnordered(story.NewStep().Expect("pray").Set("score += 5").Respond("you prayed"))
+
+	t.Run("variables are set by branches", func(t *testing.T) {
+		st := &story.State{}
+		str.ResponsesTo(st, "left")
+		assert.Equal(t, story.Vars{"visited_garden": 1, "score": 1}, st.Vars)
+	})
+
+	t.Run("variables are set by unordered steps", func(t *testing.T) {
+		st := &story.State{Vars: story.Vars{"score": 1}}
+		str.ResponsesTo(st, "pray")
+		assert.Equal(t, 6, st.Vars["score"])
+	})
+
+	tests := []struct {
+		name string
+		vars story.Vars
+		want string
+	}{
+		{"first condition", story.Vars{"visited_garden": 1, "score": 2}, "garden ending"},
+		{"second condition", story.Vars{"score": 2}, "cellar ending"},
+		{"no condition holds", story.Vars{"score": 1}, "bad ending"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := str.ResponsesTo(&story.State{Step: 1, Vars: tt.vars}, "open")
+			assert.Equal(t, tt.want, rs[0].Text(), "want response depending on variables")
+		})
+	}
+
+	assert.Equal(t, "open the door", str.ResponsesTo(&story.State{Step: 1, Vars: story.Vars{"score": 2}}, "close")[0].Text(), "want fail when expectation is not met")
+}
+
+func TestResponseJSON(t *testing.T) {
+	str := story.New().I18n(story.I18nMap{"ru": {"late": "поздно"}}).
+		Add(story.NewStep().Expect("go").Respond("now", "late").Fail("no").Additional(1, "time", time.Minute)).
+		Add(story.NewStep().Expect("next").Respond("done"))
+
+	rs := str.ResponsesTo(&story.State{Lang: "ru"}, "go")
+	require.Len(t, rs, 2)
+
+	b, err := json.Marshal(rs[1])
+	require.NoError(t, err)
+
+	var got story.Response
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, rs[1], got)
+	assert.Equal(t, "поздно", got.Text())
+	assert.Equal(t, time.Minute, got.Additional["time"])
+
+	tr := str.I18nMap().Translate([]story.Response{got}, "en")
+	assert.Equal(t, "late", tr[0].Text(), "want original text kept for translation")
+}
+
+func TestButtons(t *testing.T) {
+	str := story.New().
+		I18n(story.I18nMap{"ru": {"yes": "да", "no": "нет", "really?": "правда?"}}).
+		Add(story.NewStep().Expect("begin").Respond("hello", "really?").Fail("begin?")).
+		Add(story.NewStep().Expect("yes").InlineButtons([]string{"yes", "no"}).Respond("good").Fail("really?"))
+
+	rs := str.ResponsesTo(&story.State{Lang: "ru"}, "begin")
+	require.Len(t, rs, 2)
+	assert.Nil(t, rs[0].Keyboard(), "want buttons only with the last response")
+	assert.Equal(t, &story.Keyboard{Inline: true, Rows: [][]string{{"да", "нет"}}}, rs[1].Keyboard(), "want translated buttons of the next step")
+
+	tr := str.I18nMap().Translate(rs, "en")
+	assert.Equal(t, &story.Keyboard{Inline: true, Rows: [][]string{{"yes", "no"}}}, tr[1].Keyboard(), "want buttons translated with the response")
+
+	assert.Equal(t, "good", str.ResponsesTo(&story.State{Step: 1, Lang: "ru"}, "да")[0].Text(), "want pressed button accepted")
+}
+
+func TestBranchDelays(t *testing.T) {
+	str, err := story.Load(strings.NewReader(`[
+		{
+			"expect": "go",
+			"responses": ["now", "later"],
+			"later": {"1": 60},
+			"branches": [
+				{"expect": "run", "responses": ["fast", "faster"]},
+				{"expect": "walk", "responses": ["slow", "slower"], "later": {"0": 10}},
+				{"expect": "crawl"}
+			],
+			"fail": "go?"
+		}
+	]`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		m    string
+		want []interface{}
+	}{
+		{"go", []interface{}{nil, time.Minute}},
+		{"run", []interface{}{nil, nil}},
+		{"walk", []interface{}{time.Second * 10, nil}},
+		{"crawl", []interface{}{nil, time.Minute}},
+		{"stop", []interface{}{nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.m, func(t *testing.T) {
+			rs := str.ResponsesTo(&story.State{}, tt.m)
+			require.Len(t, rs, len(tt.want))
+			for i, r := range rs {
+				got := r.Additional["time"]
+				assert.Equal(t, tt.want[i], got, "want delays of the responses which are sent, response %d", i)
+			}
+		})
+	}
+}
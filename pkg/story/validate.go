@@ -0,0 +1,376 @@
+package story
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Problem is an issue found in a story by Validate.
+// Step is the index of the step in the story file, or -1 if the problem is not about a particular step.
+type Problem struct {
+	Step    int
+	Message string
+}
+
+// String returns a human readable description of the Problem
+func (p Problem) String() string {
+	if p.Step < 0 {
+		return p.Message
+	}
+
+	return fmt.Sprintf("step %d: %s", p.Step, p.Message)
+}
+
+// Validate loads a story and its i18n from JSON and reports problems which Load silently accepts:
+// steps without responses, ordered steps without fail messages, delayed responses out of range,
+// duplicate commands and unordered steps, unordered steps shadowing ordered ones,
+// location and venue responses with wrong coordinates, inline buttons longer than Telegram allows,
+// albums as the last responses before buttons,
+// i18n keys not used in the story, lines translated only in some languages
+// and translated regular expressions which cannot be compiled.
+// i18n can be nil, then i18n is not checked.
+// An error is returned only if the story or i18n cannot be loaded at all.
+func Validate(story, i18n io.Reader) ([]Problem, error) {
+	js, _, err := decodeStory(story)
+	if err != nil {
+		return nil, err
+	}
+	steps := js.Steps
+
+	var ps []Problem
+	var le *LoadError
+	str, err := build(js)
+	// Steps without responses are reported by validateSteps, all of them
+	if errors.As(err, &le) && !errors.Is(le.Err, errNoResponses) {
+		ps = append(ps, Problem{le.Step, fmt.Sprintf("field %q: %v", le.Field, le.Err)})
+	}
+
+	ps = append(ps, validateSteps(steps)...)
+	if err == nil || le != nil && errors.Is(le.Err, errNoResponses) {
+		ps = append(ps, validateAlbumButtons(str, steps)...)
+	}
+
+	if i18n == nil {
+		return ps, nil
+	}
+
+	m, err := LoadI18n(i18n)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ps, validateI18n(steps, m)...), nil
+}
+
+func validateSteps(steps []JSONStep) []Problem {
+	var ps []Problem
+	add := func(i int, format string, args ...interface{}) {
+		ps = append(ps, Problem{i, fmt.Sprintf(format, args...)})
+	}
+
+	ordered := make(map[string]int)
+	for i, ss := range steps {
+		if !ss.Command && !ss.Unordered {
+			for _, e := range ss.expectations() {
+				ordered[strings.ToLower(e)] = i
+			}
+		}
+	}
+
+	cmds := make(map[string]int)
+	unordered := make(map[string]int)
+	for i, ss := range steps {
+		rs := ss.responses()
+		if len(rs) == 0 && !ss.branchesRespond() {
+			add(i, "no responses")
+		}
+
+		for j := range ss.Later {
+			if j < 0 || j >= len(rs) {
+				add(i, "later response %d is out of range of %d responses", j, len(rs))
+			}
+		}
+		for k, b := range ss.Branches {
+			brs := b.responses()
+			if b.Later != nil && brs == nil {
+				add(i, "branch %d has later responses but no responses of its own", k)
+				continue
+			}
+			for j := range b.Later {
+				if j < 0 || j >= len(brs) {
+					add(i, "branch %d later response %d is out of range of %d responses", k, j, len(brs))
+				}
+			}
+		}
+
+		for _, row := range ss.InlineButtons {
+			for _, l := range row {
+				if len(l) > maxCallbackData {
+					add(i, "inline button %q is longer than %d bytes", l, maxCallbackData)
+				}
+			}
+		}
+
+		for _, l := range ss.sentTexts() {
+			if err := checkPlace(l); err != nil {
+				add(i, "%v", err)
+			}
+		}
+
+		expect := ""
+		if ss.Expect != nil {
+			expect = *ss.Expect
+		}
+
+		switch {
+		case ss.Command:
+			if j, ok := cmds[expect]; ok {
+				add(i, "command %q duplicates step %d", expect, j)
+			}
+			cmds[expect] = i
+		case ss.Unordered:
+			key := strings.ToLower(expect)
+			if j, ok := unordered[key]; ok {
+				add(i, "unordered %q duplicates step %d", expect, j)
+			}
+			unordered[key] = i
+
+			if j, ok := ordered[key]; ok {
+				add(i, "unordered %q shadows expectation of step %d", expect, j)
+			}
+		default:
+			if ss.Fail == "" && len(ss.Hints) == 0 {
+				add(i, "no fail message")
+			}
+		}
+	}
+
+	return ps
+}
+
+func validateI18n(steps []JSONStep, m I18nMap) []Problem {
+	lines := map[string]bool{I18nLanguageChanged: true}
+	for _, ss := range steps {
+		for _, l := range ss.lines() {
+			lines[l] = true
+		}
+	}
+
+	langs := make([]string, 0, len(m))
+	var translated []string
+	seen := make(map[string]bool)
+	for lang, tr := range m {
+		langs = append(langs, lang)
+		for l := range tr {
+			if lines[l] && !seen[l] {
+				seen[l] = true
+				translated = append(translated, l)
+			}
+		}
+	}
+	sort.Strings(langs)
+	sort.Strings(translated)
+
+	var ps []Problem
+	for _, lang := range langs {
+		for _, l := range sortedKeys(m[lang]) {
+			if !lines[l] {
+				ps = append(ps, Problem{-1, fmt.Sprintf("i18n %s: %q does not match any line", lang, l)})
+			}
+		}
+
+		for _, l := range translated {
+			if _, ok := m[lang][l]; !ok && l != I18nLanguageChanged {
+				ps = append(ps, Problem{-1, fmt.Sprintf("i18n %s: no translation for %q", lang, l)})
+			}
+		}
+
+		for _, l := range sortedKeys(m[lang]) {
+			if err := checkPlace(m[lang][l]); err != nil {
+				ps = append(ps, Problem{-1, fmt.Sprintf("i18n %s: %v", lang, err)})
+			}
+		}
+
+		for i, ss := range steps {
+			for _, row := range ss.InlineButtons {
+				for _, l := range row {
+					if tr, ok := m[lang][l]; ok && len(tr) > maxCallbackData {
+						ps = append(ps, Problem{i, fmt.Sprintf("i18n %s: inline button %q is longer than %d bytes", lang, tr, maxCallbackData)})
+					}
+				}
+			}
+		}
+
+		for i, ss := range steps {
+			if ss.ExpectRegex == nil {
+				continue
+			}
+			if tr, ok := m[lang][*ss.ExpectRegex]; ok {
+				if _, err := regexp.Compile(expectationRegex(tr)); err != nil {
+					ps = append(ps, Problem{i, fmt.Sprintf("i18n %s: expectRegex %q: %v", lang, tr, err)})
+				}
+			}
+		}
+	}
+
+	return ps
+}
+
+// validateAlbumButtons reports albums which are the last responses when the story comes to a step with buttons.
+// Buttons are sent with the last response, and Telegram cannot attach them to an album.
+func validateAlbumButtons(s *Story, steps []JSONStep) []Problem {
+	// Ordered steps are kept by the story in the order of the file
+	var ordered []int
+	for i, ss := range steps {
+		if !ss.Command && !ss.Unordered {
+			ordered = append(ordered, i)
+		}
+	}
+	if len(ordered) == 0 {
+		return nil
+	}
+
+	var ps []Problem
+	check := func(i int, what string, rs []JSONResponse, next int) {
+		if len(rs) == 0 || rs[len(rs)-1].Type != MediaAlbum {
+			return
+		}
+		if next = s.rotateStep(next); s.steps[next].keyboard != nil {
+			ps = append(ps, Problem{i, fmt.Sprintf("%s end with an album, it cannot have buttons of step %d", what, ordered[next])})
+		}
+	}
+
+	stp := 0
+	for i, ss := range steps {
+		if ss.Command || ss.Unordered {
+			// Otherwise the story stays at the step of the user, which is not known
+			if next, ok := s.ids[ss.Goto]; ok {
+				check(i, "responses", ss.responses(), next)
+			}
+			continue
+		}
+
+		check(i, "responses", ss.responses(), s.target(ss.Goto, stp))
+		for k, b := range ss.Branches {
+			rs, target := b.responses(), b.Goto
+			if rs == nil {
+				rs = ss.responses()
+			}
+			if target == "" {
+				target = ss.Goto
+			}
+			check(i, fmt.Sprintf("branch %d responses", k), rs, s.target(target, stp))
+		}
+		stp++
+	}
+
+	return ps
+}
+
+func sortedKeys(m map[string]string) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+func (ss JSONStep) responses() []JSONResponse {
+	switch {
+	case ss.Response != nil:
+		return []JSONResponse{*ss.Response}
+	case ss.Responses != nil:
+		return ss.Responses
+	}
+	return nil
+}
+
+func (b JSONBranch) responses() []JSONResponse {
+	switch {
+	case b.Response != nil:
+		return []JSONResponse{*b.Response}
+	case b.Responses != nil:
+		return b.Responses
+	}
+	return nil
+}
+
+// responseLines returns texts of the responses, captions for media and album items
+func responseLines(rs []JSONResponse) []string {
+	lines, _ := jsonResponses(rs)
+	for _, r := range rs {
+		lines = append(lines, r.captions()...)
+	}
+	return lines
+}
+
+// sentTexts returns texts of the step which are sent as they are: plain responses of the step and its branches,
+// fail messages and hints
+func (ss JSONStep) sentTexts() []string {
+	rs := ss.responses()
+	for _, b := range ss.Branches {
+		rs = append(rs, b.responses()...)
+	}
+
+	var ts []string
+	for _, r := range rs {
+		if r.media() == nil {
+			ts = append(ts, r.Text)
+		}
+	}
+	if ss.Fail != "" {
+		ts = append(ts, ss.Fail)
+	}
+	return append(ts, ss.Hints...)
+}
+
+// branchesRespond returns whether the step has branches and all of them have their own responses
+func (ss JSONStep) branchesRespond() bool {
+	for _, b := range ss.Branches {
+		if len(b.responses()) == 0 {
+			return false
+		}
+	}
+	return len(ss.Branches) > 0
+}
+
+// expectations returns all text expectations of the step, including branches
+func (ss JSONStep) expectations() []string {
+	var es []string
+	if ss.Expect != nil {
+		es = append(es, *ss.Expect)
+	}
+	es = append(es, ss.ExpectAny...)
+	for _, b := range ss.Branches {
+		if b.Expect != "" {
+			es = append(es, b.Expect)
+		}
+	}
+	return es
+}
+
+// lines returns all lines of the step which can be translated
+func (ss JSONStep) lines() []string {
+	ls := append(ss.expectations(), responseLines(ss.responses())...)
+	if ss.ExpectRegex != nil {
+		ls = append(ls, *ss.ExpectRegex)
+	}
+	if ss.Fail != "" {
+		ls = append(ls, ss.Fail)
+	}
+	ls = append(ls, ss.Hints...)
+	for _, rows := range [][][]string{ss.Buttons, ss.InlineButtons} {
+		for _, row := range rows {
+			ls = append(ls, row...)
+		}
+	}
+	for _, b := range ss.Branches {
+		ls = append(ls, responseLines(b.responses())...)
+	}
+	return ls
+}
@@ -0,0 +1,138 @@
+package story_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	str := `[
+		{"command": true, "expect": "start", "response": "let's start"},
+		{"command": true, "expect": "start", "response": "let's start again"},
+		{"unordered": true, "expect": "Help", "response": "help"},
+		{"unordered": true, "expect": "help", "response": "help again"},
+		{"unordered": true, "expect": "Step 1", "response": "shadow"},
+		{"expect": "step 1", "response": "at step 2"},
+		{"expect": "step 2", "fail": "still step 2"},
+		{"expect": "step 3", "responses": ["one", "two"], "later": {"2": 10}, "fail": "still step 3"},
+		{"branches": [{"expect": "left", "response": "garden", "later": {"1": 5}}], "hints": ["left?"]},
+		{"expect": "step 4", "response": "finish", "fail": "still step 4", "goto": "nowhere"}
+	]`
+	i18n := `{
+		"ru": {
+			"step 1": "шаг 1",
+			"finish": "финиш",
+			"not a line": "не строка"
+		},
+		"kk": {
+			"step 1": "қадам 1"
+		}
+	}`
+
+	ps, err := story.Validate(strings.NewReader(str), strings.NewReader(i18n))
+	require.NoError(t, err, "unexpected error validating story")
+
+	got := make([]string, len(ps))
+	for i, p := range ps {
+		got[i] = p.String()
+	}
+
+	assert.Equal(t, []string{
+		`step 9: field "goto": "nowhere": unknown step`,
+		`step 1: command "start" duplicates step 0`,
+		`step 3: unordered "help" duplicates step 2`,
+		`step 4: unordered "Step 1" shadows expectation of step 5`,
+		`step 5: no fail message`,
+		`step 6: no responses`,
+		`step 7: later response 2 is out of range of 2 responses`,
+		`step 8: branch 0 later response 1 is out of range of 1 responses`,
+		`i18n kk: no translation for "finish"`,
+		`i18n ru: "not a line" does not match any line`,
+	}, got)
+}
+
+func TestValidateWithoutI18n(t *testing.T) {
+	ps, err := story.Validate(strings.NewReader(`[{"expect": "a", "response": "b", "fail": "c"}]`), nil)
+	require.NoError(t, err)
+	assert.Empty(t, ps, "want no problems in proper story")
+}
+
+func TestValidateLoadingError(t *testing.T) {
+	_, err := story.Validate(strings.NewReader(""), nil)
+	require.Error(t, err, "want error when story cannot be loaded")
+
+	_, err = story.Validate(strings.NewReader("[]"), strings.NewReader(""))
+	require.Error(t, err, "want error when i18n cannot be loaded")
+}
+
+func TestValidateTranslatedRegex(t *testing.T) {
+	str := `[{"expectRegex": "^red (door|gate)$", "response": "it opens", "fail": "which one?"}]`
+	i18n := `{
+		"ru": {"^red (door|gate)$": "^красн(ая|ые) (дверь|ворота)$"},
+		"kk": {"^red (door|gate)$": "^(broken$"}
+	}`
+
+	ps, err := story.Validate(strings.NewReader(str), strings.NewReader(i18n))
+	require.NoError(t, err)
+	require.Len(t, ps, 1, "want only the broken translation reported")
+	assert.Equal(t, 0, ps[0].Step)
+	assert.Contains(t, ps[0].String(), `step 0: i18n kk: expectRegex "^(broken$"`)
+}
+
+func TestValidatePlaces(t *testing.T) {
+	str := `[
+		{"expect": "map", "responses": ["location:43.257169, 76.924515", "venue:43.25,76.92,Theatre, Abay Ave 1, Almaty"], "fail": "map?"},
+		{"expect": "pin", "response": "location:43.257169;76.924515", "fail": "location:north"},
+		{"expect": "far", "responses": ["location:143,76", "venue:43.25,76.92,Theatre"], "fail": "far?"},
+		{"branches": [{"expect": "left", "response": "venue:x,76.92,Theatre,Abay Ave 1"}], "hints": ["left?"]}
+	]`
+	i18n := `{"ru": {"map?": "location:43,76,7"}}`
+
+	ps, err := story.Validate(strings.NewReader(str), strings.NewReader(i18n))
+	require.NoError(t, err)
+
+	got := make([]string, len(ps))
+	for i, p := range ps {
+		got[i] = p.String()
+	}
+	assert.Equal(t, []string{
+		`step 1: location "43.257169;76.924515": want latitude and longitude like 43.257169,76.924515`,
+		`step 1: location "north": want latitude and longitude like 43.257169,76.924515`,
+		`step 2: location "143,76": want latitude and longitude like 43.257169,76.924515`,
+		`step 2: venue "43.25,76.92,Theatre": want title and address after coordinates`,
+		`step 3: venue "x,76.92,Theatre,Abay Ave 1": want latitude and longitude like 43.257169,76.924515`,
+		`i18n ru: location "43,76,7": want latitude and longitude like 43.257169,76.924515`,
+	}, got)
+}
+
+func TestValidateButtons(t *testing.T) {
+	album := `{"type": "album", "items": [{"type": "photo", "url": "one.jpg"}, {"type": "photo", "url": "two.jpg"}]}`
+	long := strings.Repeat("a", 65)
+	str := `[
+		{"expect": "go", "responses": ["look", ` + album + `], "fail": "go?", "buttons": [["go"]]},
+		{"id": "ask", "expect": "yes", "response": "fine", "fail": "yes?", "inlineButtons": [["yes", "` + long + `"]],
+			"branches": [{"expect": "later", "responses": [` + album + `], "goto": "end"}]},
+		{"unordered": true, "expect": "help", "responses": [` + album + `], "goto": "ask"},
+		{"id": "end", "expect": "bye", "responses": [` + album + `], "fail": "bye?"}
+	]`
+	i18n := `{"ru": {"yes": "` + strings.Repeat("да", 20) + `"}}`
+
+	ps, err := story.Validate(strings.NewReader(str), strings.NewReader(i18n))
+	require.NoError(t, err)
+
+	got := make([]string, len(ps))
+	for i, p := range ps {
+		got[i] = p.String()
+	}
+	assert.Equal(t, []string{
+		`step 1: inline button "` + long + `" is longer than 64 bytes`,
+		`step 0: responses end with an album, it cannot have buttons of step 1`,
+		`step 2: responses end with an album, it cannot have buttons of step 1`,
+		`step 3: responses end with an album, it cannot have buttons of step 0`,
+		`step 1: i18n ru: inline button "` + strings.Repeat("да", 20) + `" is longer than 64 bytes`,
+	}, got)
+}
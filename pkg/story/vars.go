@@ -0,0 +1,161 @@
+package story
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrExpression is returned when a variable assignment or a condition cannot be parsed
+var ErrExpression = errors.New("wrong expression")
+
+// Vars holds variables of a user going through the story, like flags and counters.
+// Flags are stored as 1 for true and 0 for false.
+type Vars map[string]int
+
+// State holds everything the story needs to know about a user to respond.
+// Fails is the count of consecutive failed attempts at the current step.
+type State struct {
+	Step  int
+	Lang  string
+	Vars  Vars
+	Fails int
+}
+
+type assignment struct {
+	name, op string
+	value    int
+}
+
+type comparison struct {
+	name, op string
+	value    int
+}
+
+// parseAssignment parses expressions like "visited = true", "score += 1" or "lives -= 1"
+func parseAssignment(e string) (assignment, error) {
+	for _, op := range []string{"+=", "-=", "="} {
+		if i := strings.Index(e, op); i >= 0 {
+			v, err := parseValue(e[i+len(op):])
+			if err != nil || !isName(e[:i]) {
+				return assignment{}, fmt.Errorf("%q: %w", e, ErrExpression)
+			}
+			return assignment{strings.TrimSpace(e[:i]), op, v}, nil
+		}
+	}
+
+	return assignment{}, fmt.Errorf("%q: %w", e, ErrExpression)
+}
+
+// parseCondition parses expressions like "visited", "!visited" or "score >= 2".
+// Several comparisons can be joined with "&&", then all of them should hold.
+func parseCondition(e string) ([]comparison, error) {
+	var cs []comparison
+	for _, part := range strings.Split(e, "&&") {
+		c, err := parseComparison(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", e, err)
+		}
+		cs = append(cs, c)
+	}
+
+	return cs, nil
+}
+
+func parseComparison(e string) (comparison, error) {
+	for _, op := range []string{">=", "<=", "==", "!=", ">", "<"} {
+		if i := strings.Index(e, op); i >= 0 {
+			if !isName(e[:i]) {
+				return comparison{}, ErrExpression
+			}
+			v, err := parseValue(e[i+len(op):])
+			return comparison{strings.TrimSpace(e[:i]), op, v}, err
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(e, "!") && isName(e[1:]):
+		return comparison{strings.TrimSpace(e[1:]), "==", 0}, nil
+	case isName(e):
+		return comparison{e, "!=", 0}, nil
+	}
+
+	return comparison{}, ErrExpression
+}
+
+func parseValue(v string) (int, error) {
+	switch v = strings.TrimSpace(v); v {
+	case "true":
+		return 1, nil
+	case "false":
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, ErrExpression
+	}
+	return i, nil
+}
+
+func isName(n string) bool {
+	n = strings.TrimSpace(n)
+	return n != "" && !strings.ContainsAny(n, " \t!=<>+-&")
+}
+
+// Set applies assignments to the variables. Wrong assignments are ignored,
+// stories loaded with Load or LoadYAML cannot have them.
+func (v Vars) Set(exprs ...string) {
+	for _, e := range exprs {
+		a, err := parseAssignment(e)
+		if err != nil {
+			continue
+		}
+
+		switch a.op {
+		case "+=":
+			v[a.name] += a.value
+		case "-=":
+			v[a.name] -= a.value
+		default:
+			v[a.name] = a.value
+		}
+	}
+}
+
+// Holds returns whether the condition holds for the variables.
+// Empty condition always holds, wrong one never does.
+func (v Vars) Holds(cond string) bool {
+	if cond == "" {
+		return true
+	}
+
+	cs, err := parseCondition(cond)
+	if err != nil {
+		return false
+	}
+
+	for _, c := range cs {
+		if !c.holds(v[c.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c comparison) holds(x int) bool {
+	switch c.op {
+	case ">=":
+		return x >= c.value
+	case "<=":
+		return x <= c.value
+	case ">":
+		return x > c.value
+	case "<":
+		return x < c.value
+	case "!=":
+		return x != c.value
+	}
+	return x == c.value
+}
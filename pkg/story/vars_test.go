@@ -0,0 +1,47 @@
+package story_test
+
+import (
+	"testing"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVarsSet(t *testing.T) {
+	vars := story.Vars{"score": 2, "lives": 3}
+	vars.Set("visited = true", "score += 1", "lives -= 2", "hidden = false", "level = -1", "wrong expression", " = 1", "a b += 1")
+
+	assert.Equal(t, story.Vars{"visited": 1, "score": 3, "lives": 1, "hidden": 0, "level": -1}, vars)
+}
+
+func TestVarsHolds(t *testing.T) {
+	vars := story.Vars{"visited": 1, "score": 2}
+
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"", true},
+		{"visited", true},
+		{"!visited", false},
+		{"unknown", false},
+		{"!unknown", true},
+		{"score >= 2", true},
+		{"score > 2", false},
+		{"score <= 1", false},
+		{"score < 3", true},
+		{"score == 2", true},
+		{"score != 2", false},
+		{"visited && score == 2", true},
+		{"visited && score > 2", false},
+		{"score >> 2", false},
+		{"a b > 1", false},
+		{"> 1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cond, func(t *testing.T) {
+			assert.Equal(t, tt.want, vars.Holds(tt.cond))
+		})
+	}
+}
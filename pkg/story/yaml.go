@@ -0,0 +1,249 @@
+package story
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadYAML loads story steps from given YAML file.
+// The structure is the same as for Load, so any JSON story can be written in YAML:
+//   - command: true
+//     expect: start
+//     response: let's start
+//   - expect: go to step 2
+//     responses:
+//   - |
+//     A long response
+//     on several lines
+//   - audio:http://example.com/audio.mp3
+//     later:
+//     1: 600
+//     fail: still at step 1
+//
+// Like for Load, the story can be a mapping with settings and steps:
+//
+//	tolerance: 1
+//	steps:
+//	  - expect: start
+//	    response: let's start
+//
+// Errors are returned as *LoadError pointing to the line and column in the YAML file.
+func LoadYAML(r io.Reader) (*Story, error) {
+	js, src, err := decodeYAMLStory(r)
+	if err != nil {
+		return New(), err
+	}
+
+	s, err := build(js)
+	if err != nil {
+		return s, src.locate(err)
+	}
+
+	return s, nil
+}
+
+// YAMLToJSON converts a YAML story to JSON, keeping the order of fields
+func YAMLToJSON(w io.Writer, r io.Reader) error {
+	var root yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&root); err != nil {
+		return &LoadError{Step: -1, Err: err}
+	}
+
+	b := &bytes.Buffer{}
+	if err := writeNodeJSON(b, &root); err != nil {
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, b.Bytes(), "", "  "); err != nil {
+		return err
+	}
+	out.WriteString("\n")
+
+	_, err := out.WriteTo(w)
+	return err
+}
+
+// JSONToYAML converts a JSON story to YAML, keeping the order of fields.
+// Multi-line texts are written as YAML block scalars.
+func JSONToYAML(w io.Writer, r io.Reader) error {
+	var root yaml.Node
+	// JSON is a subset of YAML
+	if err := yaml.NewDecoder(r).Decode(&root); err != nil {
+		return &LoadError{Step: -1, Err: err}
+	}
+
+	blockStyle(&root)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// yamlSource keeps YAML nodes of loaded steps to point at errors in the file
+type yamlSource struct {
+	steps []*yaml.Node
+}
+
+// decodeYAMLStory decodes the story, which is either a sequence of steps or a mapping with settings and steps
+func decodeYAMLStory(r io.Reader) (JSONStory, *yamlSource, error) {
+	var js JSONStory
+	var root yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&root); err != nil {
+		return js, nil, &LoadError{Step: -1, Err: err}
+	}
+
+	doc := root.Content[0]
+	if doc.Kind == yaml.MappingNode {
+		var steps *yaml.Node
+		for i := 0; i < len(doc.Content); i += 2 {
+			k, v := doc.Content[i], doc.Content[i+1]
+			var err error
+			switch strings.ToLower(k.Value) {
+			case "tolerance":
+				err = v.Decode(&js.Tolerance)
+			case "steps":
+				steps = v
+			default:
+				// Most likely a step outside of the sequence
+				err = errNotArray
+			}
+			if err != nil {
+				return js, nil, &LoadError{Step: -1, Field: k.Value, Line: k.Line, Column: k.Column, Err: err}
+			}
+		}
+
+		if steps == nil {
+			return js, nil, &LoadError{Step: -1, Line: doc.Line, Column: doc.Column, Err: errNotArray}
+		}
+		doc = steps
+	}
+	if doc.Kind != yaml.SequenceNode {
+		return js, nil, &LoadError{Step: -1, Line: doc.Line, Column: doc.Column, Err: errNotArray}
+	}
+
+	src := &yamlSource{steps: doc.Content}
+	js.Steps = make([]JSONStep, 0, len(doc.Content))
+	for i, n := range doc.Content {
+		b := &bytes.Buffer{}
+		if err := writeNodeJSON(b, n); err != nil {
+			return js, src, &LoadError{Step: i, Line: n.Line, Column: n.Column, Err: err}
+		}
+
+		var ss JSONStep
+		if err := strictUnmarshal(b.Bytes(), &ss); err != nil {
+			return js, src, src.locate(stepError(i, err))
+		}
+		js.Steps = append(js.Steps, ss)
+	}
+
+	return js, src, nil
+}
+
+// locate sets line and column of LoadError using the step and the field of the error
+func (src *yamlSource) locate(err error) error {
+	var le *LoadError
+	if !errors.As(err, &le) || le.Step < 0 || le.Step >= len(src.steps) {
+		return err
+	}
+
+	n := src.steps[le.Step]
+	if le.Field != "" {
+		name := le.Field
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		if k := findKey(n, name); k != nil {
+			n = k
+		}
+	}
+
+	le.Line, le.Column = n.Line, n.Column
+	return le
+}
+
+// findKey looks for a mapping key with the name in the node and its children
+func findKey(n *yaml.Node, name string) *yaml.Node {
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i < len(n.Content); i += 2 {
+			if strings.EqualFold(n.Content[i].Value, name) {
+				return n.Content[i]
+			}
+		}
+	}
+
+	for _, c := range n.Content {
+		if k := findKey(c, name); k != nil {
+			return k
+		}
+	}
+	return nil
+}
+
+// writeNodeJSON writes YAML node as JSON keeping the order of mapping keys
+func writeNodeJSON(b *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		return writeNodeJSON(b, n.Content[0])
+	case yaml.AliasNode:
+		return writeNodeJSON(b, n.Alias)
+	case yaml.SequenceNode:
+		b.WriteString("[")
+		for i, c := range n.Content {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			if err := writeNodeJSON(b, c); err != nil {
+				return err
+			}
+		}
+		b.WriteString("]")
+	case yaml.MappingNode:
+		b.WriteString("{")
+		for i := 0; i < len(n.Content); i += 2 {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			k, _ := json.Marshal(n.Content[i].Value)
+			b.Write(k)
+			b.WriteString(":")
+			if err := writeNodeJSON(b, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		b.WriteString("}")
+	default:
+		var v interface{}
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		j, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		b.Write(j)
+	}
+
+	return nil
+}
+
+// blockStyle makes the node look like a usual YAML document instead of JSON
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!str" && strings.Contains(n.Value, "\n") {
+		n.Style = yaml.LiteralStyle
+	}
+
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
@@ -0,0 +1,101 @@
+package story_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadingFromYAML(t *testing.T) {
+	f, err := os.Open("testdata/story.yaml")
+	require.NoError(t, err, "unexpected error loading test file")
+	defer f.Close()
+
+	str, err := story.LoadYAML(f)
+	require.NoError(t, err, "unexpected error when loading proper YAML for the story")
+
+	assert.Equal(t, "now at step 2", str.ResponsesWithLangStepTo(0, "", "go to step 2")[0].Text(), "want response message to expectation")
+	assert.Equal(t, "proper geo", str.ResponsesWithLangStepTo(1, "", "43.257081,76.924835")[0].Text(), "want response to geo expectation")
+	assert.Equal(t, "let's start", str.ResponsesWithLangStepTo(99, "", "/start")[0].Text(), "want response message to command")
+	assert.Equal(t, "out of order", str.ResponsesWithLangStepTo(66, "", "unordered")[0].Text(), "want response message to unordered step")
+	assert.Equal(t, time.Second*600, str.ResponsesWithLangStepTo(3, "", "multi")[2].Additional["time"], "want time field on 3rd response of 4th step")
+	assert.Equal(t, 7, str.ResponsesWithLangStepTo(5, "", "right")[0].Next(), "want branch to lead to named step")
+	assert.Equal(t, "A long response\non several lines\n", str.ResponsesWithLangStepTo(10, "", "long")[0].Text(), "want block scalar response")
+}
+
+func TestLoadYAMLErrorPosition(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		step  int
+		field string
+		line  int
+		col   int
+	}{
+		{"unknown field", "- expect: a\n  response: b\n- expect: c\n  respones: [d]\n", 1, "respones", 4, 3},
+		{"wrong type", "- expect:\n    a: b\n", 0, "expect", 1, 3},
+		{"wrong goto", "- expect: a\n  goto: nowhere\n", 0, "goto", 2, 3},
+		{"not an array", "5\n", -1, "", 1, 1},
+		{"step outside of sequence", "expect: a\n", -1, "expect", 1, 1},
+		{"wrong story tolerance", "tolerance: [1]\nsteps: []\n", -1, "tolerance", 1, 1},
+		{"step error in mapping", "tolerance: 1\nsteps:\n  - expect: a\n    respones: [d]\n", 0, "respones", 4, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := story.LoadYAML(strings.NewReader(tt.yaml))
+
+			var le *story.LoadError
+			require.ErrorAs(t, err, &le, "want LoadError")
+			assert.Equal(t, tt.step, le.Step, "want step index")
+			assert.Equal(t, tt.field, le.Field, "want field name")
+			assert.Equal(t, tt.line, le.Line, "want line")
+			assert.Equal(t, tt.col, le.Column, "want column")
+		})
+	}
+
+	_, err := story.LoadYAML(strings.NewReader("- expect: [a"))
+	require.Error(t, err, "want syntax error")
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	j := `[
+  {
+    "expect": "multi",
+    "responses": [
+      "first",
+      "second\nline"
+    ],
+    "later": {
+      "1": 600
+    },
+    "expectGeo": {
+      "lat": 43.25,
+      "lon": 76.92,
+      "precision": 50
+    }
+  }
+]
+`
+
+	y := &bytes.Buffer{}
+	require.NoError(t, story.JSONToYAML(y, strings.NewReader(j)), "unexpected error converting to YAML")
+	assert.Contains(t, y.String(), "- expect: multi\n  responses:\n    - first\n    - |-\n      second\n      line\n")
+
+	back := &bytes.Buffer{}
+	require.NoError(t, story.YAMLToJSON(back, y), "unexpected error converting to JSON")
+	assert.Equal(t, j, back.String(), "want the same JSON after round trip")
+}
+
+func TestLoadYAMLStoryTolerance(t *testing.T) {
+	str, err := story.LoadYAML(strings.NewReader("tolerance: 1\nsteps:\n  - expect: red rose\n    response: nice\n    fail: wrong\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "nice", str.ResponsesWithLangStepTo(0, "", "red roze")[0].Text(), "want story tolerance used by steps")
+}
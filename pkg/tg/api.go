@@ -0,0 +1,82 @@
+package tg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// APIError is an unsuccessful answer of Telegram Bot API
+type APIError struct {
+	Method      string        // Method is the called method, like "sendMessage"
+	Code        int           // Code is error_code of the answer, or its HTTP status if the answer is not JSON
+	Description string        // Description is a human-readable explanation of the error
+	RetryAfter  time.Duration // RetryAfter is how long to wait before calling again after too many requests
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("tg: %s: %d %s", e.Method, e.Code, e.Description)
+}
+
+// Temporary reports whether calling again later may succeed: after too many requests or a server error
+func (e *APIError) Temporary() bool {
+	return e.Code == http.StatusTooManyRequests || e.Code >= http.StatusInternalServerError
+}
+
+// Forbidden reports whether the bot cannot send to the chat anymore,
+// like when the user blocked the bot or deleted the chat, or the chat is not found
+func (e *APIError) Forbidden() bool {
+	return e.Code == http.StatusForbidden ||
+		e.Code == http.StatusBadRequest && strings.Contains(strings.ToLower(e.Description), "chat not found")
+}
+
+// IsForbidden reports whether the error is an APIError telling the bot cannot send to the chat anymore
+func IsForbidden(err error) bool {
+	var ae *APIError
+	return errors.As(err, &ae) && ae.Forbidden()
+}
+
+// Retry tells how to call Telegram again after temporary failures:
+// server errors, too many requests and network errors of idempotent methods
+type Retry struct {
+	Attempts int           // Attempts is how many times a call is made at most
+	Backoff  time.Duration // Backoff is the wait before the second attempt, it doubles for every next one
+	MaxWait  time.Duration // MaxWait limits waits, a call told to wait longer after too many requests fails
+}
+
+// DefaultRetry is used by clients created with NewClient
+var DefaultRetry = Retry{Attempts: 3, Backoff: 500 * time.Millisecond, MaxWait: time.Minute}
+
+// idempotent are methods which change nothing when called twice.
+// Only they are called again after network errors, because Telegram may have got the call before the connection broke,
+// and a message sent again would reach the user twice.
+var idempotent = map[string]bool{
+	"getMe":          true,
+	"getUpdates":     true,
+	"setWebhook":     true,
+	"deleteWebhook":  true,
+	"setMyCommands":  true,
+	"sendChatAction": true,
+}
+
+// temporary reports whether the error of a call of the method may go away if the call is made again.
+// Answers of too many requests and server errors are temporary.
+// Network errors are temporary for idempotent methods, but errors of the request itself, like too many redirects, are not.
+func temporary(method string, err error) bool {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return ae.Temporary()
+	}
+
+	var ue *url.Error
+	if !idempotent[method] || !errors.As(err, &ue) {
+		return false
+	}
+	var ne net.Error
+	return errors.As(ue.Err, &ne) || errors.Is(ue.Err, io.EOF) || errors.Is(ue.Err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,184 @@
+package tg_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/session"
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/asahnoln/mesproc/pkg/tg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type apiAnswer struct {
+	status int
+	body   string
+}
+
+// stubAPIServer gives the answers in order, and successful answers after them
+type stubAPIServer struct {
+	mu      sync.Mutex
+	answers []apiAnswer
+	gotPath []string
+	gotAt   []time.Time
+}
+
+func (s *stubAPIServer) start(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.gotPath = append(s.gotPath, r.URL.Path)
+		s.gotAt = append(s.gotAt, time.Now())
+		a := apiAnswer{http.StatusOK, `{"ok":true,"result":{}}`}
+		if len(s.answers) > 0 {
+			a, s.answers = s.answers[0], s.answers[1:]
+		}
+		w.WriteHeader(a.status)
+		w.Write([]byte(a.body))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+func (s *stubAPIServer) paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.gotPath...)
+}
+
+var fastRetry = tg.Retry{Attempts: 3, Backoff: time.Millisecond, MaxWait: time.Second * 5}
+
+// retrying makes the Handler call Telegram at the target with the retry rules
+func retrying(target string, r tg.Retry) tg.Option {
+	c := tg.NewClient(target)
+	c.Retry = r
+	return tg.WithClient(c)
+}
+
+func TestTooManyRequests(t *testing.T) {
+	stg := &stubAPIServer{answers: []apiAnswer{
+		{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`},
+	}}
+	str := story.New().Add(story.NewStep().Expect("go").Respond("hi"))
+	target := stg.start(t)
+	th := tg.New(target, str, nil, retrying(target, fastRetry))
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "go"}})
+
+	require.Equal(t, []string{"/sendMessage", "/sendMessage"}, stg.paths())
+	assert.GreaterOrEqual(t, stg.gotAt[1].Sub(stg.gotAt[0]), time.Second, "want retry_after honoured")
+}
+
+func TestRetryErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		retry    tg.Retry
+		answers  []apiAnswer
+		attempts int
+		logged   string
+	}{
+		{"bad request is not retried",
+			tg.Retry{Attempts: 3, Backoff: time.Millisecond},
+			[]apiAnswer{{http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: message text is empty"}`}},
+			1, "tg: sendMessage: 400 Bad Request: message text is empty"},
+		{"server errors are retried until attempts end",
+			tg.Retry{Attempts: 3, Backoff: time.Millisecond},
+			[]apiAnswer{{http.StatusBadGateway, "<html>bad gateway</html>"}, {http.StatusBadGateway, ""}, {http.StatusBadGateway, ""}},
+			3, "tg: sendMessage: 502 Bad Gateway"},
+		{"too long wait is not waited",
+			tg.Retry{Attempts: 3, Backoff: time.Millisecond, MaxWait: time.Second},
+			[]apiAnswer{{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 30","parameters":{"retry_after":30}}`}},
+			1, "tg: sendMessage: 429 Too Many Requests"},
+		{"zero retry makes one attempt",
+			tg.Retry{},
+			[]apiAnswer{{http.StatusInternalServerError, ""}},
+			1, "tg: sendMessage: 500 Internal Server Error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stg := &stubAPIServer{answers: tt.answers}
+			b := &bytes.Buffer{}
+			str := story.New().Add(story.NewStep().Expect("go").Respond("hi"))
+			target := stg.start(t)
+			th := tg.New(target, str, log.New(b, "", 0), retrying(target, tt.retry))
+
+			th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "go"}})
+
+			assert.Len(t, stg.paths(), tt.attempts)
+			assert.Contains(t, b.String(), tt.logged)
+		})
+	}
+}
+
+func TestBlockedUserInactive(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer apiAnswer
+	}{
+		{"blocked", apiAnswer{http.StatusForbidden, `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`}},
+		{"chat not found", apiAnswer{http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stg := &stubAPIServer{answers: []apiAnswer{tt.answer}}
+			str := story.New().Add(story.NewStep().
+				Expect("go").
+				Respond("now", "one more", "later").
+				Additional(2, "time", time.Hour))
+			store := session.NewMemory()
+			target := stg.start(t)
+			th := tg.New(target, str, nil, retrying(target, fastRetry), tg.WithSessionStore(store))
+
+			th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "go"}})
+
+			assert.Equal(t, []string{"/sendMessage"}, stg.paths(), "want nothing else sent to blocked user")
+			assert.Empty(t, th.PendingResponses(1), "want delayed responses cancelled")
+			sess, err := store.Load(1)
+			require.NoError(t, err)
+			assert.True(t, sess.Inactive)
+
+			th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "/start"}})
+
+			sess, err = store.Load(1)
+			require.NoError(t, err)
+			assert.False(t, sess.Inactive, "want user writing again active")
+		})
+	}
+}
+
+func TestBlockedUserInactiveOnDelayedResponse(t *testing.T) {
+	blocked := apiAnswer{http.StatusForbidden, `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`}
+	stg := &stubAPIServer{}
+	str := story.New().Add(story.NewStep().
+		Expect("go").
+		Respond("now", "later", "much later").
+		Additional(1, "time", time.Hour).
+		Additional(2, "time", time.Hour*2))
+	store := session.NewMemory()
+	c := newFakeClock()
+	target := stg.start(t)
+	th := tg.New(target, str, nil, retrying(target, fastRetry), tg.WithSessionStore(store), tg.WithScheduler(tg.NewMemoryScheduler(c)))
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "go"}})
+	require.Len(t, th.PendingResponses(1), 2)
+
+	stg.mu.Lock()
+	stg.answers = []apiAnswer{blocked}
+	stg.mu.Unlock()
+	c.Advance(time.Hour)
+
+	assert.Empty(t, th.PendingResponses(1), "want the rest of delayed responses cancelled")
+	sess, err := store.Load(1)
+	require.NoError(t, err)
+	assert.True(t, sess.Inactive)
+}
@@ -0,0 +1,304 @@
+package tg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout limits every call of clients created with NewClient, uploads included
+const DefaultTimeout = time.Minute
+
+// Client calls Telegram Bot API.
+// Answers which are not ok are returned as *APIError, temporary failures are retried, see Retry.
+type Client struct {
+	Target string       // Target is the address of the bot, like "https://api.telegram.org/bot<token>"
+	HTTP   *http.Client // HTTP makes requests, http.DefaultClient is used if it is nil
+	Retry  Retry        // Retry tells how to call again after temporary failures, zero Retry makes one attempt
+	Logger *log.Logger  // Logger logs answers and retries if it is set
+}
+
+// WithClient makes the Handler call Telegram with the given Client.
+// By default it uses NewClient with the target and the logger of the Handler.
+func WithClient(c *Client) Option {
+	return func(h *Handler) {
+		h.client = c
+	}
+}
+
+// NewClient creates a Client with DefaultTimeout and DefaultRetry
+func NewClient(target string) *Client {
+	return &Client{
+		Target: target,
+		HTTP:   &http.Client{Timeout: DefaultTimeout},
+		Retry:  DefaultRetry,
+	}
+}
+
+// Call calls the method, like "getMe", with params encoded as JSON and returns the result of the answer
+func (c *Client) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	m, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("tg: %s: %w", method, err)
+	}
+
+	return c.post(ctx, "/"+method, "application/json", m)
+}
+
+// Send sends the message of the Sender to its chat.
+// The result is the sent message, or the sent messages for a media group.
+func (c *Client) Send(ctx context.Context, v Sender) (json.RawMessage, error) {
+	return c.Call(ctx, strings.TrimPrefix(v.URL(), "/"), v)
+}
+
+// SendMessage sends a text message and returns the sent message
+func (c *Client) SendMessage(ctx context.Context, m SendMessage) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &m, &sent)
+	return sent, err
+}
+
+// SendPhoto sends a photo and returns the sent message
+func (c *Client) SendPhoto(ctx context.Context, p SendPhoto) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &p, &sent)
+	return sent, err
+}
+
+// SendAudio sends an audio and returns the sent message
+func (c *Client) SendAudio(ctx context.Context, a SendAudio) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &a, &sent)
+	return sent, err
+}
+
+// SendVoice sends a voice message and returns the sent message
+func (c *Client) SendVoice(ctx context.Context, v SendVoice) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &v, &sent)
+	return sent, err
+}
+
+// SendVideo sends a video and returns the sent message
+func (c *Client) SendVideo(ctx context.Context, v SendVideo) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &v, &sent)
+	return sent, err
+}
+
+// SendVideoNote sends a round video note and returns the sent message
+func (c *Client) SendVideoNote(ctx context.Context, v SendVideoNote) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &v, &sent)
+	return sent, err
+}
+
+// SendDocument sends a document and returns the sent message
+func (c *Client) SendDocument(ctx context.Context, d SendDocument) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &d, &sent)
+	return sent, err
+}
+
+// SendAnimation sends an animation and returns the sent message
+func (c *Client) SendAnimation(ctx context.Context, a SendAnimation) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &a, &sent)
+	return sent, err
+}
+
+// SendSticker sends a sticker and returns the sent message
+func (c *Client) SendSticker(ctx context.Context, s SendSticker) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &s, &sent)
+	return sent, err
+}
+
+// SendLocation sends a location pin and returns the sent message
+func (c *Client) SendLocation(ctx context.Context, l SendLocation) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &l, &sent)
+	return sent, err
+}
+
+// SendVenue sends a venue and returns the sent message
+func (c *Client) SendVenue(ctx context.Context, v SendVenue) (Message, error) {
+	var sent Message
+	err := c.sendFor(ctx, &v, &sent)
+	return sent, err
+}
+
+// SendMediaGroup sends an album and returns its sent messages
+func (c *Client) SendMediaGroup(ctx context.Context, g SendMediaGroup) ([]Message, error) {
+	var sent []Message
+	err := c.sendFor(ctx, &g, &sent)
+	return sent, err
+}
+
+// SendChatAction tells the user the bot is doing something, like uploading a photo
+func (c *Client) SendChatAction(ctx context.Context, id int, action string) error {
+	_, err := c.Call(ctx, "sendChatAction", SendChatAction{ChatID: id, Action: action})
+	return err
+}
+
+// AnswerCallbackQuery tells Telegram the pressed inline button is handled, so it stops showing progress
+func (c *Client) AnswerCallbackQuery(ctx context.Context, id string) error {
+	_, err := c.Call(ctx, "answerCallbackQuery", AnswerCallbackQuery{CallbackQueryID: id})
+	return err
+}
+
+// GetMe returns the bot itself, which is a simple way to check the token
+func (c *Client) GetMe(ctx context.Context) (User, error) {
+	var u User
+	err := c.callFor(ctx, "getMe", struct{}{}, &u)
+	return u, err
+}
+
+// GetUpdates receives updates by long polling. Timeout of HTTP should be longer than the timeout of polling.
+func (c *Client) GetUpdates(ctx context.Context, g GetUpdates) ([]Update, error) {
+	var us []Update
+	err := c.callFor(ctx, "getUpdates", g, &us)
+	return us, err
+}
+
+// SetWebhook makes Telegram send updates to the URL of the webhook.
+// A self-signed certificate is uploaded from its file.
+func (c *Client) SetWebhook(ctx context.Context, w SetWebhook) error {
+	if w.Certificate == "" {
+		_, err := c.Call(ctx, "setWebhook", w)
+		return err
+	}
+
+	body, contentType, err := multipartBody(w, []upload{{part: "certificate", path: w.Certificate}})
+	if err != nil {
+		return err
+	}
+	_, err = c.post(ctx, "/setWebhook", contentType, body)
+	return err
+}
+
+// DeleteWebhook stops Telegram sending updates to the webhook, so they can be received by long polling
+func (c *Client) DeleteWebhook(ctx context.Context, dropPendingUpdates bool) error {
+	_, err := c.Call(ctx, "deleteWebhook", DeleteWebhook{DropPendingUpdates: dropPendingUpdates})
+	return err
+}
+
+// SetMyCommands sets commands the users see in the menu of the bot
+func (c *Client) SetMyCommands(ctx context.Context, s SetMyCommands) error {
+	_, err := c.Call(ctx, "setMyCommands", s)
+	return err
+}
+
+// callFor calls the method and decodes its result into v
+func (c *Client) callFor(ctx context.Context, method string, params, v interface{}) error {
+	result, err := c.Call(ctx, method, params)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(result, v); err != nil {
+		return fmt.Errorf("tg: %s result: %w", method, err)
+	}
+	return nil
+}
+
+// sendFor sends the message of the Sender and decodes the sent message into v
+func (c *Client) sendFor(ctx context.Context, s Sender, v interface{}) error {
+	return c.callFor(ctx, strings.TrimPrefix(s.URL(), "/"), s, v)
+}
+
+// post posts the body to the Telegram endpoint, like "/sendMessage",
+// and returns the result of the answer. Temporary failures are retried.
+func (c *Client) post(ctx context.Context, endpoint, contentType string, body []byte) (json.RawMessage, error) {
+	wait := c.Retry.Backoff
+	for attempt := 1; ; attempt++ {
+		result, err := c.postOnce(ctx, endpoint, contentType, body)
+		if err == nil || attempt >= c.Retry.Attempts || !temporary(strings.TrimPrefix(endpoint, "/"), err) {
+			return result, err
+		}
+
+		d := wait
+		var ae *APIError
+		if errors.As(err, &ae) && ae.RetryAfter > 0 {
+			if c.Retry.MaxWait > 0 && ae.RetryAfter > c.Retry.MaxWait {
+				return nil, err
+			}
+			d = ae.RetryAfter
+		}
+		if c.Retry.MaxWait > 0 && d > c.Retry.MaxWait {
+			d = c.Retry.MaxWait
+		}
+
+		c.logf("retrying in %v after err: %v", d, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("tg: %s: %w", strings.TrimPrefix(endpoint, "/"), ctx.Err())
+		case <-time.After(d):
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) postOnce(ctx context.Context, endpoint, contentType string, body []byte) (json.RawMessage, error) {
+	method := strings.TrimPrefix(endpoint, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Target+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("tg: %s: %w", method, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	c.logf("%s: response from telegram: %#v, error %#v", time.Now().Format(time.RFC3339), resp, err)
+	if err != nil {
+		return nil, fmt.Errorf("tg: %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	var a struct {
+		OK          bool            `json:"ok"`
+		ErrorCode   int             `json:"error_code"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		// Proxies in front of Telegram answer errors with pages instead of JSON
+		if resp.StatusCode >= http.StatusBadRequest {
+			return nil, &APIError{Method: method, Code: resp.StatusCode, Description: http.StatusText(resp.StatusCode)}
+		}
+		return nil, fmt.Errorf("tg: %s answer: %w", method, err)
+	}
+
+	if !a.OK {
+		code := a.ErrorCode
+		if code == 0 {
+			code = resp.StatusCode
+		}
+		return nil, &APIError{
+			Method:      method,
+			Code:        code,
+			Description: a.Description,
+			RetryAfter:  time.Duration(a.Parameters.RetryAfter) * time.Second,
+		}
+	}
+
+	return a.Result, nil
+}
+
+func (c *Client) logf(format string, v ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,214 @@
+package tg_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/asahnoln/mesproc/pkg/tg"
+	"github.com/asahnoln/mesproc/pkg/tg/tgtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientMethods(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+	c := tg.NewClient(srv.URL)
+	ctx := context.Background()
+
+	me, err := c.GetMe(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "test_bot", me.Username)
+	assert.True(t, me.IsBot)
+
+	srv.AddUpdates(tg.Update{UpdateID: 5, Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "hello"}})
+	us, err := c.GetUpdates(ctx, tg.GetUpdates{Offset: 5, Timeout: 1})
+	require.NoError(t, err)
+	require.Len(t, us, 1)
+	assert.Equal(t, "hello", us[0].Message.Text)
+
+	require.NoError(t, c.SetMyCommands(ctx, tg.SetMyCommands{Commands: []tg.BotCommand{{Command: "start", Description: "Start the story"}}}))
+	require.NoError(t, c.DeleteWebhook(ctx, true))
+
+	result, err := c.Send(ctx, &tg.SendMessage{ChatID: 7, Text: "hi"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"message_id":1,"chat":{"id":7}}`, string(result))
+
+	rs := srv.Requests()
+	require.Len(t, rs, 5)
+	assert.Equal(t, []string{"getMe", "getUpdates", "setMyCommands", "deleteWebhook", "sendMessage"}, srv.Methods())
+	assert.Equal(t, float64(5), rs[1].Params["offset"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"command": "start", "description": "Start the story"}}, rs[2].Params["commands"])
+	assert.Equal(t, true, rs[3].Params["drop_pending_updates"])
+	assert.Equal(t, "hi", rs[4].Params["text"])
+}
+
+func TestClientSendMethods(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+	c := tg.NewClient(srv.URL)
+	ctx := context.Background()
+
+	m, err := c.SendMessage(ctx, tg.SendMessage{ChatID: 7, Text: "hi"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, m.MessageID)
+	assert.Equal(t, 7, m.Chat.ID)
+
+	m, err = c.SendPhoto(ctx, tg.SendPhoto{ChatID: 7, Photo: "photo_id", Caption: "look"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, m.MessageID)
+
+	m, err = c.SendVenue(ctx, tg.SendVenue{ChatID: 7, Latitude: 43.25, Longitude: 76.92, Title: "Theatre", Address: "Abay 1"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, m.MessageID)
+
+	ms, err := c.SendMediaGroup(ctx, tg.SendMediaGroup{ChatID: 7, Media: []tg.InputMedia{{Type: "photo", Media: "a"}, {Type: "photo", Media: "b"}}})
+	require.NoError(t, err)
+	require.Len(t, ms, 2)
+	assert.Equal(t, 5, ms[1].MessageID)
+
+	assert.Equal(t, []string{"sendMessage", "sendPhoto", "sendVenue", "sendMediaGroup"}, srv.Methods())
+	rs := srv.Requests()
+	assert.Equal(t, "look", rs[1].Params["caption"])
+	assert.Equal(t, "Theatre", rs[2].Params["title"])
+
+	srv.Answer("sendSticker", tgtest.Error(http.StatusBadRequest, "Bad Request: wrong file identifier"))
+	_, err = c.SendSticker(ctx, tg.SendSticker{ChatID: 7, Sticker: "bad"})
+	var ae *tg.APIError
+	assert.ErrorAs(t, err, &ae, "want API errors of typed methods")
+}
+
+func TestClientSetWebhook(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+	c := tg.NewClient(srv.URL)
+
+	cert := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(cert, []byte("public key"), 0644))
+
+	w := tg.SetWebhook{URL: "https://example.com/bot", SecretToken: "secret", AllowedUpdates: []string{"message", "callback_query"}}
+	require.NoError(t, c.SetWebhook(context.Background(), w))
+	w.Certificate = cert
+	require.NoError(t, c.SetWebhook(context.Background(), w))
+
+	rs := srv.Requests("setWebhook")
+	require.Len(t, rs, 2)
+	assert.Equal(t, "application/json", rs[0].ContentType)
+	assert.Equal(t, "https://example.com/bot", rs[0].Params["url"])
+	assert.Equal(t, "secret", rs[0].Params["secret_token"])
+	assert.Empty(t, rs[0].Files)
+
+	assert.Equal(t, "multipart/form-data", rs[1].ContentType, "want certificate uploaded")
+	assert.Equal(t, "public key", rs[1].Files["certificate"])
+	assert.Equal(t, "https://example.com/bot", rs[1].Params["url"])
+	assert.Equal(t, []interface{}{"message", "callback_query"}, rs[1].Params["allowed_updates"])
+}
+
+func TestClientErrors(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+	c := tg.NewClient(srv.URL)
+	c.Retry = tg.Retry{Attempts: 3, Backoff: time.Millisecond}
+
+	srv.Answer("sendMessage", tgtest.Error(http.StatusForbidden, "Forbidden: bot was blocked by the user"))
+	_, err := c.Send(context.Background(), &tg.SendMessage{ChatID: 1, Text: "hi"})
+	var ae *tg.APIError
+	require.ErrorAs(t, err, &ae)
+	assert.Equal(t, "sendMessage", ae.Method)
+	assert.Equal(t, "Forbidden: bot was blocked by the user", ae.Description)
+	assert.True(t, tg.IsForbidden(err))
+
+	srv.Answer("sendMessage", tgtest.Error(http.StatusBadRequest, "Bad Request: chat not found"))
+	_, err = c.Send(context.Background(), &tg.SendMessage{ChatID: 1, Text: "hi"})
+	assert.True(t, tg.IsForbidden(err), "want missing chat forbidden too")
+
+	srv.Answer("getMe", tgtest.Error(http.StatusBadGateway, "Bad Gateway"), tgtest.Error(http.StatusBadGateway, "Bad Gateway"))
+	_, err = c.GetMe(context.Background())
+	assert.NoError(t, err, "want temporary errors retried")
+	assert.Len(t, srv.Requests("getMe"), 3)
+}
+
+func TestClientNetworkErrors(t *testing.T) {
+	// Every first call of a method breaks the connection without an answer
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		first := calls[r.URL.Path] == 1
+		mu.Unlock()
+
+		if first {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer srv.Close()
+
+	c := tg.NewClient(srv.URL)
+	c.Retry = tg.Retry{Attempts: 3, Backoff: time.Millisecond}
+
+	_, err := c.GetMe(context.Background())
+	assert.NoError(t, err, "want idempotent call retried")
+	assert.NoError(t, c.SendChatAction(context.Background(), 1, "typing"))
+
+	_, err = c.Send(context.Background(), &tg.SendMessage{ChatID: 1, Text: "hi"})
+	assert.Error(t, err, "want message not sent again, it may have reached the user")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"/getMe": 2, "/sendChatAction": 2, "/sendMessage": 1}, calls)
+}
+
+func TestClientContext(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+	c := tg.NewClient(srv.URL)
+	c.Retry = tg.Retry{Attempts: 3, Backoff: time.Hour}
+
+	srv.Answer("getMe", tgtest.TooManyRequests(30))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err := c.GetMe(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "want waiting for retry stopped by context")
+	assert.Len(t, srv.Requests("getMe"), 1)
+}
+
+func TestClientTimeout(t *testing.T) {
+	blocking := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocking
+	}))
+	defer srv.Close()
+	defer close(blocking)
+
+	c := tg.NewClient(srv.URL)
+	c.HTTP = &http.Client{Timeout: time.Millisecond * 50}
+	c.Retry = tg.Retry{}
+
+	_, err := c.GetMe(context.Background())
+	assert.Error(t, err, "want call stopped by timeout of HTTP client")
+}
+
+func TestHandlerWithClient(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+
+	str := story.New().Add(story.NewStep().Expect("go").Respond("photo:http://example.com/pic.jpg", "done"))
+	th := tg.New("", str, nil, tg.WithClient(tg.NewClient(srv.URL)))
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 3}, Text: "go"}})
+
+	assert.Equal(t, []string{"sendChatAction", "sendPhoto", "sendMessage"}, srv.Methods())
+	assert.Equal(t, "http://example.com/pic.jpg", srv.Requests("sendPhoto")[0].Params["photo"])
+}
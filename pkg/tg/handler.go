@@ -2,14 +2,19 @@
 package tg
 
 import (
-	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/asahnoln/mesproc/pkg/session"
 	"github.com/asahnoln/mesproc/pkg/story"
 )
 
@@ -18,21 +23,78 @@ const (
 	PrefixAudio = "audio:"
 	// PrefixPhoto identifies text as a sendPhoto candidate
 	PrefixPhoto = "photo:"
+	// PrefixVoice identifies text as a sendVoice candidate
+	PrefixVoice = "voice:"
+	// PrefixVideo identifies text as a sendVideo candidate
+	PrefixVideo = "video:"
+	// PrefixVideoNote identifies text as a sendVideoNote candidate
+	PrefixVideoNote = "videonote:"
+	// PrefixDocument identifies text as a sendDocument candidate
+	PrefixDocument = "document:"
+	// PrefixAnimation identifies text as a sendAnimation candidate
+	PrefixAnimation = "animation:"
+	// PrefixSticker identifies text as a sendSticker candidate
+	PrefixSticker = "sticker:"
+	// PrefixLocation identifies text as a sendLocation candidate, like "location:43.257169,76.924515"
+	PrefixLocation = story.PrefixLocation
+	// PrefixVenue identifies text as a sendVenue candidate, like "venue:43.257169,76.924515,Title,Address".
+	// The title cannot have commas.
+	PrefixVenue = story.PrefixVenue
 )
 
-type usrCfg struct {
-	step   int
-	lang   string
-	lastRs []story.Response
+// maxUpdateSize limits the body of an update posted to the webhook
+const maxUpdateSize = 1 << 20
+
+// SecretTokenHeader is the header with the secret token of the webhook in every update from Telegram
+const SecretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// AllowedUpdates are kinds of updates the Handler processes, they should be given to setWebhook or getUpdates
+var AllowedUpdates = []string{"message", "callback_query"}
+
+// mediaSenders are senders for prefixes of response texts and for media types of structured responses
+var mediaSenders = []struct {
+	prefix, media string
+	sender        func() Sender
+}{
+	{PrefixAudio, story.MediaAudio, func() Sender { return &SendAudio{} }},
+	{PrefixPhoto, story.MediaPhoto, func() Sender { return &SendPhoto{} }},
+	{PrefixVoice, story.MediaVoice, func() Sender { return &SendVoice{} }},
+	{PrefixVideo, story.MediaVideo, func() Sender { return &SendVideo{} }},
+	{PrefixVideoNote, story.MediaVideoNote, func() Sender { return &SendVideoNote{} }},
+	{PrefixDocument, story.MediaDocument, func() Sender { return &SendDocument{} }},
+	{PrefixAnimation, story.MediaAnimation, func() Sender { return &SendAnimation{} }},
+	{PrefixSticker, story.MediaSticker, func() Sender { return &SendSticker{} }},
+	{PrefixLocation, "", func() Sender { return &SendLocation{} }},
+	{PrefixVenue, "", func() Sender { return &SendVenue{} }},
 }
 
 // Handler is a Telegram handler, which implements receiving messages from a bot and sending them back
 type Handler struct {
-	target  string
-	str     *story.Story
-	usrCfgs map[int]*usrCfg
-	lgr     *log.Logger
-	timers  []*time.Timer
+	client *Client
+	str    *story.Story
+	sess   session.Store
+	lgr    *log.Logger
+	sched  Scheduler
+	lanes  *lanes
+
+	files    FileCache
+	local    *localFiles
+	mediaDir string
+	limiter  *Limiter
+	secret   string
+	reply    bool
+	wg       sync.WaitGroup
+}
+
+// Option configures a Handler created by New
+type Option func(*Handler)
+
+// WithScheduler makes the Handler keep delayed responses in the given Scheduler.
+// By default they are kept in memory.
+func WithScheduler(s Scheduler) Option {
+	return func(h *Handler) {
+		h.sched = s
+	}
 }
 
 // Sender is an interface for different sending options, like sendMessage, sendAudio etc.
@@ -45,19 +107,88 @@ type Sender interface {
 	URL() string       // URL returns Telegram endpoint to process current sender
 }
 
+// MarkupSender is a Sender which can offer buttons to the user
+type MarkupSender interface {
+	SetReplyMarkup(interface{}) // SetReplyMarkup sets a keyboard for current sender
+}
+
+// CaptionSender is a Sender of media which can have a caption
+type CaptionSender interface {
+	SetCaption(string) // SetCaption sets a caption for current sender
+}
+
+// FormattedSender is a Sender which text can be formatted with a parse mode, like "HTML" or "MarkdownV2"
+type FormattedSender interface {
+	SetParseMode(string) // SetParseMode sets a parse mode for current sender
+}
+
+// CheckedSender is a Sender which content can be wrong, like coordinates of a location
+type CheckedSender interface {
+	ContentErr() error // ContentErr returns the error of the content set by SetContent
+}
+
 type ChatActionSender interface {
 	GetChatID() int     // Returns chat ID
 	ChatAction() string // Chat action for current sender
 }
 
+// WithSessionStore makes the Handler keep progress of users in the given store,
+// so they continue the story where they were after restart.
+// By default progress is kept in memory.
+func WithSessionStore(s session.Store) Option {
+	return func(h *Handler) {
+		h.sess = s
+	}
+}
+
+// WithSecretToken makes the Handler accept only updates with the token in X-Telegram-Bot-Api-Secret-Token header.
+// Telegram sends the token given to setWebhook, so updates forged by others are rejected.
+func WithSecretToken(token string) Option {
+	return func(h *Handler) {
+		h.secret = token
+	}
+}
+
+// WithWebhookReply makes the Handler answer the webhook with the response to the update,
+// when it is the only response to send right away, which saves a call to Telegram.
+// Such updates are processed before the webhook is answered,
+// and Telegram does not tell if the response fails, like when the user blocked the bot.
+func WithWebhookReply() Option {
+	return func(h *Handler) {
+		h.reply = true
+	}
+}
+
 // New creates a Telegram handler.
-func New(target string, str *story.Story, logger *log.Logger) *Handler {
-	return &Handler{
-		target:  target,
-		str:     str,
-		usrCfgs: make(map[int]*usrCfg),
-		lgr:     logger,
+func New(target string, str *story.Story, logger *log.Logger, opts ...Option) *Handler {
+	client := NewClient(target)
+	client.Logger = logger
+	h := &Handler{
+		client: client,
+		str:    str,
+		sess:   session.NewMemory(),
+		lgr:    logger,
+		sched:  NewMemoryScheduler(RealClock),
+		lanes:  newLanes(),
+		files:  NewMemoryFileCache(),
+		local:  newLocalFiles(),
 	}
+	for _, o := range opts {
+		o(h)
+	}
+
+	h.sched.Start(h.sendTimedResponse)
+	return h
+}
+
+// PendingResponses returns delayed responses of the chat which are not sent yet
+func (h *Handler) PendingResponses(id int) []story.Response {
+	return h.sched.Pending(id)
+}
+
+// CancelPending cancels delayed responses of the chat and returns how many were cancelled
+func (h *Handler) CancelPending(id int) int {
+	return h.sched.Cancel(id)
 }
 
 // receive gets an Update from a bot
@@ -66,128 +197,204 @@ func (h *Handler) receive(w http.ResponseWriter, r *http.Request) (Update, error
 	// TODO: Handle error
 	err := json.NewDecoder(r.Body).Decode(&u)
 	if err != nil {
-		h.lgr.Printf("receive error: %v", err)
+		h.logf("receive error: %v", err)
 		return u, fmt.Errorf("tg: handler receive: %w", err)
 	}
 
-	h.logIncoming(u)
 	return u, nil
 }
 
 func (h *Handler) logIncoming(u Update) {
-	if h.lgr != nil {
-		h.lgr.Printf("%s: telegram update: %#v", time.Now().Format(time.RFC3339), u)
-	}
+	h.logf("%s: telegram update: %#v", time.Now().Format(time.RFC3339), u)
 }
 
-func (h *Handler) logSending(r *http.Response, err error) {
+// logf logs with the logger of the Handler, if it has one
+func (h *Handler) logf(format string, v ...interface{}) {
 	if h.lgr != nil {
-		h.lgr.Printf("%s: response from telegram: %#v, error %#v", time.Now().Format(time.RFC3339), r, err)
+		h.lgr.Printf(format, v...)
 	}
 }
 
-// send sends back a Sender
-func (h *Handler) send(u Update) {
+// send sends back responses to the update.
+// If reply is given, the only response to send right away is kept in it instead.
+func (h *Handler) send(u Update, reply *webhookReply) {
 	id := u.Message.Chat.ID
-	uCfg := h.prepareUserConfig(id, u)
+	sess, err := h.prepareSession(id, u)
+	if err != nil {
+		h.logf("session err: %v", err)
+		return
+	}
 
-	if h.runTimedResponses() {
+	// Any message skips ahead to the next delayed response of the same chat
+	if h.sched.Skip(id) {
+		h.saveSession(id, sess)
 		return
 	}
 
-	rs := h.str.ResponsesWithLangStepTo(uCfg.step, uCfg.lang, convertText(u))
-	rs, translated := h.translateLastResponses(uCfg, rs)
+	st := &story.State{Step: sess.Step, Lang: sess.Lang, Vars: sess.Vars, Fails: sess.Fails}
+	rs := h.str.ResponsesTo(st, convertText(u))
+	sess.Vars = st.Vars
+	if len(rs) == 0 {
+		h.logf("send response err: no responses to %q at step %d", convertText(u), sess.Step)
+		h.saveSession(id, sess)
+		return
+	}
+	rs, translated := h.translateLastResponses(sess, rs)
+
+	immediate := 0
+	for _, r := range rs {
+		if _, ok := r.Additional["time"]; !ok {
+			immediate++
+		}
+	}
 
 	for _, r := range rs {
 		if t, ok := r.Additional["time"]; ok {
-			h.addTimedResponse(r, t.(time.Duration), id)
-		} else {
-			err := h.sendResponse(r, id)
+			err := h.sched.Add(id, r, t.(time.Duration))
 			if err != nil {
-				// TODO: Do something
-				h.lgr.Printf("send response err: %v", err)
+				h.logf("schedule response err: %v", err)
 			}
+			continue
 		}
 
+		v := h.sender(r, id)
+		// The reply reaches the user after the request ends, so responses sent by calls would overtake it
+		if reply != nil && immediate == 1 && reply.take(h, v, id) {
+			continue
+		}
+
+		err := h.post(v, id)
+		if err != nil {
+			h.logf("send response err: %v", err)
+		}
+		// The user blocked the bot, nothing else can be sent to them
+		if IsForbidden(err) {
+			sess.Inactive = true
+			h.sched.Cancel(id)
+			break
+		}
 	}
 
-	uCfg.lastRs = rs
-	h.updateUsrCfg(id, uCfg, rs[0], translated)
+	sess.LastResponses = rs
+	h.updateSession(&sess, rs[0], translated)
+	h.saveSession(id, sess)
 }
 
-func (h *Handler) prepareUserConfig(id int, u Update) *usrCfg {
-	uCfg, ok := h.usrCfgs[id]
-	if !ok {
-		h.usrCfgs[id] = &usrCfg{}
-		uCfg = h.usrCfgs[id]
+func (h *Handler) prepareSession(id int, u Update) (session.Session, error) {
+	sess, err := h.sess.Load(id)
+	if err != nil && !errors.Is(err, session.ErrNotFound) {
+		return sess, fmt.Errorf("tg: load session %d: %w", id, err)
 	}
-	if uCfg.lang == "" {
-		uCfg.lang = u.Message.From.LanguageCode
+
+	// Writing to the bot means the user does not block it anymore
+	sess.Inactive = false
+	if sess.Lang == "" {
+		sess.Lang = u.Message.From.LanguageCode
 	}
 	if u.Message.Text == "/start" {
-		uCfg.step = 0
+		sess.Step = 0
+		sess.Vars = nil
+		sess.Fails = 0
 	}
 
-	return uCfg
+	return sess, nil
 }
 
-func (h *Handler) addTimedResponse(r story.Response, t time.Duration, id int) {
-	timer := time.AfterFunc(t, func() {
-		err := h.sendResponse(r, id)
-		if err != nil {
-			h.lgr.Printf("timed response err: %v", err)
-		}
-		// TODO: Write test for this one
-		if len(h.timers) > 0 {
-			h.timers = h.timers[1:]
-		}
-	})
-	h.timers = append(h.timers, timer)
+func (h *Handler) saveSession(id int, sess session.Session) {
+	err := h.sess.Save(id, sess)
+	if err != nil {
+		h.logf("session err: %v", fmt.Errorf("tg: save session %d: %w", id, err))
+	}
 }
 
-func (h *Handler) runTimedResponses() bool {
-	if len(h.timers) > 0 {
-		timer := h.timers[0]
-		timer.Reset(0)
-		return true
+func (h *Handler) sendTimedResponse(id int, r story.Response) {
+	err := h.sendResponse(r, id)
+	if err != nil {
+		h.logf("timed response err: %v", err)
+	}
+	if IsForbidden(err) {
+		h.deactivate(id)
 	}
+}
+
+// deactivate marks the session of the chat inactive and cancels its delayed responses,
+// because the user blocked the bot
+func (h *Handler) deactivate(id int) {
+	leave := h.lanes.enter(id)
+	defer leave()
 
-	return false
+	h.sched.Cancel(id)
+	sess, err := h.sess.Load(id)
+	if err != nil {
+		h.logf("session err: %v", fmt.Errorf("tg: load session %d: %w", id, err))
+		return
+	}
+	sess.Inactive = true
+	h.saveSession(id, sess)
 }
 
 func (h *Handler) sendResponse(r story.Response, id int) error {
-	v := figureSenderType(r.Text())
+	return h.post(h.sender(r, id), id)
+}
+
+// sender makes the Sender of the response to the chat
+func (h *Handler) sender(r story.Response, id int) Sender {
+	v := responseSender(r)
 	v.SetChatID(id)
+	if m, ok := v.(MarkupSender); ok && r.Keyboard() != nil {
+		m.SetReplyMarkup(replyMarkup(r.Keyboard()))
+	} else if r.Keyboard() != nil {
+		h.logf("send response err: buttons cannot be sent with %s, story.Validate reports such steps", v.URL())
+	}
+	return v
+}
 
+// post sends the Sender to Telegram within limits, uploading its local files if needed
+func (h *Handler) post(v Sender, id int) error {
+	if c, ok := v.(CheckedSender); ok && c.ContentErr() != nil {
+		return fmt.Errorf("tg: %s: %w", v.URL(), c.ContentErr())
+	}
+
+	h.limiter.Wait(id)
 	err := h.before(v)
 	if err != nil {
 		return err
 	}
 
-	// TODO: Handle error
-	m, _ := json.Marshal(v)
-	resp, err := http.Post(h.target+v.URL(), "application/json", bytes.NewReader(m))
-	h.logSending(resp, err)
+	// Local files are uploaded, unless they were uploaded before.
+	// Sends of a file being uploaded wait for its file_id.
+	keys, err := h.pendingKeys(v)
+	if err != nil {
+		return err
+	}
+	unlock := h.local.lock(keys)
+	ups, err := h.prepareUploads(v)
+	if err != nil {
+		unlock()
+		return err
+	}
+	if len(ups) > 0 {
+		defer unlock()
+		return h.postUploads(v, ups)
+	}
+	unlock()
 
+	_, err = h.client.Send(context.Background(), v)
 	return err
 }
 
-func (h *Handler) translateLastResponses(u *usrCfg, rs []story.Response) ([]story.Response, bool) {
-	if u.lastRs != nil && rs[0].Lang() != u.lang {
-		return h.str.I18nMap().Translate(u.lastRs, rs[0].Lang()), true
+func (h *Handler) translateLastResponses(sess session.Session, rs []story.Response) ([]story.Response, bool) {
+	if sess.LastResponses != nil && rs[0].Lang() != sess.Lang {
+		return h.str.I18nMap().Translate(sess.LastResponses, rs[0].Lang()), true
 	}
 	return rs, false
 }
 
 func (h *Handler) before(v Sender) error {
 	if a, ok := v.(ChatActionSender); ok {
-		m, _ := json.Marshal(SendChatAction{
-			ChatID: a.GetChatID(),
-			Action: a.ChatAction(),
-		})
-		_, err := http.Post(h.target+"/sendChatAction", "application/json", bytes.NewReader(m))
+		err := h.client.SendChatAction(context.Background(), a.GetChatID(), a.ChatAction())
 		if err != nil {
-			h.lgr.Printf("before error: %v", err)
+			h.logf("before error: %v", err)
 			return fmt.Errorf("tg: before err: %w", err)
 		}
 	}
@@ -195,20 +402,217 @@ func (h *Handler) before(v Sender) error {
 	return nil
 }
 
-func (h *Handler) updateUsrCfg(id int, u *usrCfg, r story.Response, translated bool) {
-	if r.ShouldAdvance() && !translated {
-		u.step++
+func (h *Handler) updateSession(sess *session.Session, r story.Response, translated bool) {
+	if !translated {
+		switch {
+		// The story starts over after the last step, so steps are compared as the story sees them
+		case h.str.StepIndex(r.Next()) != h.str.StepIndex(sess.Step):
+			sess.Fails = 0
+		case r.Failed():
+			sess.Fails++
+		}
+		sess.Step = r.Next()
+	}
+	sess.Lang = r.Lang()
+}
+
+// Process responds to an Update, however it was received: by webhook or by long polling.
+// It is safe to call concurrently: updates of one chat are processed one by one in the order they came,
+// updates of different chats are processed in parallel.
+// A pressed inline button is answered and processed as a message with the data of the button.
+func (h *Handler) Process(u Update) {
+	h.process(u, h.lanes.queue(updateChat(u)), nil)
+}
+
+// process responds to the update when its turn in the chat comes
+func (h *Handler) process(u Update, turn func() func(), reply *webhookReply) {
+	h.logIncoming(u)
+
+	if q := u.CallbackQuery; q != nil {
+		err := h.answerCallbackQuery(q)
+		if err != nil {
+			h.logf("callback query err: %v", err)
+		}
+		if q.Message == nil {
+			turn()()
+			return
+		}
+		u.Message = Message{Chat: q.Message.Chat, Text: q.Data, From: q.From}
 	}
-	u.lang = r.Lang()
+
+	leave := turn()
+	defer leave()
+	h.send(u, reply)
 }
 
-// ServeHTTP implements http.Handler
+// ServeHTTP implements http.Handler.
+// Updates are acknowledged right away and processed in background, see Wait,
+// unless the Handler replies to the webhook with responses.
+// Bodies larger than 1 MB are rejected, real updates are much smaller.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "updates should be posted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.authorized(r) {
+		h.logf("receive error: wrong secret token from %s", r.RemoteAddr)
+		http.Error(w, "wrong secret token", http.StatusUnauthorized)
+		return
+	}
+
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		http.Error(w, "updates should be JSON", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if r.ContentLength > maxUpdateSize {
+		http.Error(w, "update is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpdateSize)
+
 	u, err := h.receive(w, r)
 	if err != nil {
+		http.Error(w, "malformed update", http.StatusBadRequest)
+		return
+	}
+
+	if h.reply {
+		reply := &webhookReply{}
+		h.process(u, h.lanes.queue(updateChat(u)), reply)
+		reply.write(w, h)
+		return
+	}
+
+	h.dispatch(u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// dispatch processes the update in background, see Wait.
+// The place of the update in its chat is taken right away, so updates of the chat keep the order they came in.
+func (h *Handler) dispatch(u Update) {
+	turn := h.lanes.queue(updateChat(u))
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		// Nothing recovers panics of the goroutine, and one update should not stop the whole bot
+		defer func() {
+			if r := recover(); r != nil {
+				h.logf("process update panic: %v", r)
+			}
+		}()
+		h.process(u, turn, nil)
+	}()
+}
+
+// Wait waits until updates received by ServeHTTP or a Poller are processed.
+// It is useful in tests and to finish processing before the bot stops.
+func (h *Handler) Wait() {
+	h.wg.Wait()
+}
+
+// webhookReply keeps the response written in the answer to the webhook
+type webhookReply struct {
+	v Sender
+}
+
+// take keeps the Sender if it can be a reply: it is the first one and has no files to upload.
+// The reply is sent within limits like any other response.
+func (wr *webhookReply) take(h *Handler, v Sender, id int) bool {
+	if c, ok := v.(CheckedSender); wr.v != nil || ok && c.ContentErr() != nil {
+		return false
+	}
+	ups, err := h.prepareUploads(v)
+	if err != nil || len(ups) > 0 {
+		return false
+	}
+
+	h.limiter.Wait(id)
+	// The reply is sent anyway, before logs the error of the chat action
+	h.before(v)
+
+	wr.v = v
+	return true
+}
+
+// write writes the kept Sender as a Bot API method call, or just acknowledges the update
+func (wr *webhookReply) write(w http.ResponseWriter, h *Handler) {
+	if wr.v == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var m map[string]interface{}
+	b, err := json.Marshal(wr.v)
+	if err == nil {
+		err = json.Unmarshal(b, &m)
+	}
+	if err != nil {
+		h.logf("webhook reply err: %v", err)
+		w.WriteHeader(http.StatusOK)
 		return
 	}
-	h.send(u)
+	m["method"] = strings.TrimPrefix(wr.v.URL(), "/")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// authorized checks the secret token of the request if the Handler has one
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.secret == "" {
+		return true
+	}
+
+	got := r.Header.Get(SecretTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(got), []byte(h.secret)) == 1
+}
+
+// answerCallbackQuery tells Telegram the pressed inline button is handled, so it stops showing progress
+func (h *Handler) answerCallbackQuery(q *CallbackQuery) error {
+	err := h.client.AnswerCallbackQuery(context.Background(), q.ID)
+	if err != nil {
+		return fmt.Errorf("tg: answer callback query: %w", err)
+	}
+
+	return nil
+}
+
+// replyMarkup converts buttons of the story into a Telegram keyboard.
+// Inline buttons send their labels back as callback data,
+// which Telegram limits to 64 bytes, story.Validate reports longer labels.
+func replyMarkup(k *story.Keyboard) interface{} {
+	if k.Inline {
+		rows := make([][]InlineKeyboardButton, len(k.Rows))
+		for i, row := range k.Rows {
+			for _, l := range row {
+				rows[i] = append(rows[i], InlineKeyboardButton{Text: l, CallbackData: l})
+			}
+		}
+		return InlineKeyboardMarkup{InlineKeyboard: rows}
+	}
+
+	rows := make([][]KeyboardButton, len(k.Rows))
+	for i, row := range k.Rows {
+		for _, l := range row {
+			rows[i] = append(rows[i], KeyboardButton{Text: l})
+		}
+	}
+	return ReplyKeyboardMarkup{Keyboard: rows, ResizeKeyboard: true, OneTimeKeyboard: true}
+}
+
+// updateChat returns the chat of the update, which is the chat of the message with a pressed inline button
+func updateChat(u Update) int {
+	if q := u.CallbackQuery; q != nil {
+		if q.Message == nil {
+			return 0
+		}
+		return q.Message.Chat.ID
+	}
+	return u.Message.Chat.ID
 }
 
 // convertText converts Update info into text usable by Story
@@ -220,16 +624,65 @@ func convertText(u Update) string {
 	return text
 }
 
+// responseSender figures out what should be sent for the response:
+// by its media if it is structured, otherwise by the prefix of its text
+func responseSender(r story.Response) Sender {
+	m := r.Media()
+	if m == nil {
+		return figureSenderType(r.Text())
+	}
+
+	if m.Type == story.MediaAlbum {
+		return albumSender(r)
+	}
+
+	var v Sender = &SendMessage{}
+	content := r.Text()
+	for _, p := range mediaSenders {
+		if p.media == m.Type {
+			v = p.sender()
+			content = m.URL
+			if c, ok := v.(CaptionSender); ok {
+				c.SetCaption(r.Text())
+			}
+			break
+		}
+	}
+
+	v.SetContent(content)
+	if f, ok := v.(FormattedSender); ok && m.ParseMode != "" {
+		f.SetParseMode(m.ParseMode)
+	}
+
+	return v
+}
+
+// albumSender sends items of the album response as one media group.
+// Parse mode of the album applies to items without their own.
+func albumSender(r story.Response) Sender {
+	m := r.Media()
+	v := &SendMediaGroup{}
+	for _, item := range m.Items {
+		pm := item.ParseMode
+		if pm == "" {
+			pm = m.ParseMode
+		}
+		v.Media = append(v.Media, InputMedia{Type: item.Type, Media: item.URL, Caption: item.Caption, ParseMode: pm})
+	}
+
+	v.SetContent(r.Text())
+	return v
+}
+
 // figureSenderType uses received text as a way to figure out what should be sent back
 func figureSenderType(text string) Sender {
 	var v Sender = &SendMessage{}
-	switch {
-	case strings.HasPrefix(text, PrefixAudio):
-		v = &SendAudio{}
-		text = text[len(PrefixAudio):]
-	case strings.HasPrefix(text, PrefixPhoto):
-		v = &SendPhoto{}
-		text = text[len(PrefixPhoto):]
+	for _, p := range mediaSenders {
+		if strings.HasPrefix(text, p.prefix) {
+			v = p.sender()
+			text = text[len(p.prefix):]
+			break
+		}
 	}
 
 	v.SetContent(text)
@@ -3,13 +3,18 @@ package tg_test
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/asahnoln/mesproc/pkg/session"
 	"github.com/asahnoln/mesproc/pkg/story"
 	"github.com/asahnoln/mesproc/pkg/tg"
 	"github.com/stretchr/testify/assert"
@@ -17,8 +22,11 @@ import (
 )
 
 type stubTgServer struct {
+	mu                          sync.Mutex
 	gotText, gotHeader, gotPath []string
 	gotChatID                   []int
+	gotMarkup                   []interface{}
+	gotBody                     []string
 }
 
 func TestHandler(t *testing.T) {
@@ -74,9 +82,10 @@ func TestHandler(t *testing.T) {
 			require.NoError(t, err, "unexpected error while marshalling object")
 
 			w := httptest.NewRecorder()
-			r := httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body))
+			r := newUpdateRequest(body)
 
 			th.ServeHTTP(w, r)
+			th.Wait()
 
 			rs := tt.step.Responses()
 			require.Len(t, stg.gotText, len(rs), "want the same count of requests to tg server as responses")
@@ -109,8 +118,9 @@ func TestAudio(t *testing.T) {
 		},
 	})
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r := newUpdateRequest(body)
 	th.ServeHTTP(w, r)
+	th.Wait()
 
 	assert.Equal(t, "/sendChatAction", stg.gotPath[0], "want first to be sent - chat action")
 	assert.Equal(t, "application/json", stg.gotHeader[0])
@@ -140,8 +150,9 @@ func TestPhoto(t *testing.T) {
 		},
 	})
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r := newUpdateRequest(body)
 	th.ServeHTTP(w, r)
+	th.Wait()
 
 	assert.Equal(t, "/sendChatAction", stg.gotPath[0], "want first to be sent - chat action")
 	assert.Equal(t, "application/json", stg.gotHeader[0])
@@ -155,6 +166,121 @@ func TestPhoto(t *testing.T) {
 	assert.Equal(t, "http://example.com/photo.jpg", stg.gotText[1])
 }
 
+func TestMedia(t *testing.T) {
+	tests := []struct {
+		response, path, action, body string
+	}{
+		{"voice:http://example.com/voice.ogg", "/sendVoice", "upload_voice", `{"chat_id":8,"voice":"http://example.com/voice.ogg"}`},
+		{"video:http://example.com/video.mp4", "/sendVideo", "upload_video", `{"chat_id":8,"video":"http://example.com/video.mp4"}`},
+		{"videonote:http://example.com/note.mp4", "/sendVideoNote", "upload_video_note", `{"chat_id":8,"video_note":"http://example.com/note.mp4"}`},
+		{"document:http://example.com/play.pdf", "/sendDocument", "upload_document", `{"chat_id":8,"document":"http://example.com/play.pdf"}`},
+		{"animation:http://example.com/yarn.gif", "/sendAnimation", "upload_video", `{"animation":"http://example.com/yarn.gif","chat_id":8}`},
+		{"sticker:CAACAgIAAxkBAAE", "/sendSticker", "choose_sticker", `{"chat_id":8,"sticker":"CAACAgIAAxkBAAE"}`},
+		{"location:43.257169, 76.924515", "/sendLocation", "find_location", `{"chat_id":8,"latitude":43.257169,"longitude":76.924515}`},
+		{"venue:43.257169,76.924515,Theatre, Abay Ave 1, Almaty", "/sendVenue", "find_location",
+			`{"address":"Abay Ave 1, Almaty","chat_id":8,"latitude":43.257169,"longitude":76.924515,"title":"Theatre"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			stg := &stubTgServer{}
+			close, target := stg.tgServerMockURL()
+			defer close()
+
+			str := story.New().Add(story.NewStep().Expect("show").Respond(tt.response).Fail("wrong"))
+			tg.New(target, str, nil).Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 8}, Text: "show"}})
+
+			assert.Equal(t, []string{"/sendChatAction", tt.path}, stg.gotPath)
+			assert.Equal(t, []string{tt.action, tt.body}, stg.gotText)
+			assert.Equal(t, []int{8, 8}, stg.gotChatID)
+		})
+	}
+}
+
+func TestWrongLocation(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	b := &bytes.Buffer{}
+	str := story.New().Add(story.NewStep().Expect("show").Respond("location:north", "venue:43.25,76.92", "here"))
+	tg.New(target, str, log.New(b, "", 0)).Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 8}, Text: "show"}})
+
+	assert.Equal(t, []string{"/sendMessage"}, stg.gotPath, "want wrong places not sent")
+	assert.Contains(t, b.String(), `location "north"`)
+	assert.Contains(t, b.String(), `venue "43.25,76.92"`)
+}
+
+func TestStructuredResponses(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	str := story.New().
+		Add(story.NewStep().Expect("show").
+			Respond("photo: is just a word here", "<b>bold</b>", "part 2", "").
+			Media(0, story.Media{Type: story.MediaText}).
+			Media(1, story.Media{Type: story.MediaText, ParseMode: "HTML"}).
+			Media(2, story.Media{Type: story.MediaAudio, URL: "http://example.com/long.mp3", ParseMode: "HTML"}).
+			Media(3, story.Media{Type: story.MediaSticker, URL: "CAACAgIAAxkBAAE"}).
+			Fail("wrong")).
+		I18n(story.I18nMap{"ru": {"part 2": "часть 2"}})
+
+	tg.New(target, str, nil).Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 9}, Text: "show", From: tg.From{LanguageCode: "ru"}}})
+
+	assert.Equal(t, []string{"/sendMessage", "/sendMessage", "/sendChatAction", "/sendAudio", "/sendChatAction", "/sendSticker"}, stg.gotPath)
+	assert.JSONEq(t, `{"chat_id":9,"text":"photo: is just a word here"}`, stg.gotBody[0], "want literal text sent as message")
+	assert.JSONEq(t, `{"chat_id":9,"text":"<b>bold</b>","parse_mode":"HTML"}`, stg.gotBody[1])
+	assert.JSONEq(t, `{"chat_id":9,"audio":"http://example.com/long.mp3","caption":"часть 2","parse_mode":"HTML"}`, stg.gotBody[3], "want translated caption")
+	assert.JSONEq(t, `{"chat_id":9,"sticker":"CAACAgIAAxkBAAE"}`, stg.gotBody[5])
+}
+
+func TestAlbum(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	str := story.New().Add(story.NewStep().Expect("look").Respond("the room").
+		Media(0, story.Media{Type: story.MediaAlbum, ParseMode: "HTML", Items: []story.Media{
+			{Type: story.MediaPhoto, URL: "http://example.com/1.jpg"},
+			{Type: story.MediaVideo, URL: "http://example.com/2.mp4", Caption: "door"},
+		}}).Fail("wrong")).
+		Add(story.NewStep().Expect("open").Respond("it opens").Fail("wrong").Buttons([]string{"open"}))
+
+	b := &bytes.Buffer{}
+	tg.New(target, str, log.New(b, "", 0)).Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 10}, Text: "look"}})
+
+	assert.Equal(t, []string{"/sendChatAction", "/sendMediaGroup"}, stg.gotPath, "want one request for the whole album")
+	assert.JSONEq(t, `{"chat_id":10,"action":"upload_photo"}`, stg.gotBody[0])
+	assert.JSONEq(t, `{"chat_id":10,"media":[
+		{"type":"photo","media":"http://example.com/1.jpg","caption":"the room","parse_mode":"HTML"},
+		{"type":"video","media":"http://example.com/2.mp4","caption":"door","parse_mode":"HTML"}
+	]}`, stg.gotBody[1], "want album caption on the first item")
+	assert.Contains(t, b.String(), "buttons cannot be sent with /sendMediaGroup", "want lost buttons reported")
+}
+
+func TestAllMediaTypesSent(t *testing.T) {
+	for _, typ := range story.MediaTypes {
+		t.Run(typ, func(t *testing.T) {
+			stg := &stubTgServer{}
+			close, target := stg.tgServerMockURL()
+			defer close()
+
+			str := story.New().Add(story.NewStep().Expect("show").Respond("caption").
+				Media(0, story.Media{Type: typ, URL: "http://example.com/file"}).Fail("wrong"))
+			tg.New(target, str, nil).Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 9}, Text: "show"}})
+
+			require.NotEmpty(t, stg.gotPath)
+			path := stg.gotPath[len(stg.gotPath)-1]
+			if typ == story.MediaText {
+				assert.Equal(t, "/sendMessage", path)
+			} else {
+				assert.NotEqual(t, "/sendMessage", path, "want media type %q to have its own sender", typ)
+			}
+		})
+	}
+}
+
 func TestDifferentUsersStepsAndLangs(t *testing.T) {
 	str := story.New().
 		AddCommand(story.NewStep().Expect("start").Respond("startCommand").Fail("no fail")).
@@ -199,8 +325,9 @@ func TestDifferentUsersStepsAndLangs(t *testing.T) {
 		require.NoError(t, err, "unexpected error while marshaling object")
 
 		w := httptest.NewRecorder()
-		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		r := newUpdateRequest(body)
 		th.ServeHTTP(w, r)
+		th.Wait()
 
 		for j, w := range want {
 			assert.Equal(t, w, stg.gotText[j], "want response for user %d: %q", id, w)
@@ -251,6 +378,197 @@ func TestDifferentUsersStepsAndLangs(t *testing.T) {
 	}
 }
 
+func TestProgressSurvivesRestart(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	str := story.New().
+		Add(story.NewStep().Expect("step 1").Respond("go to step 2").Fail("still step 1")).
+		Add(story.NewStep().Expect("step 2").Respond("finish").Fail("still step 2")).
+		I18n(story.I18nMap{
+			"ru": {
+				"step 1":       "шаг 1",
+				"go to step 2": "идите к шагу 2",
+			},
+		})
+
+	store := session.NewFile(t.TempDir())
+	update := func(text string) tg.Update {
+		return tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 5}, Text: text, From: tg.From{LanguageCode: "ru"}}}
+	}
+
+	tg.New(target, str, nil, tg.WithSessionStore(store)).Process(update("шаг 1"))
+	require.Equal(t, []string{"идите к шагу 2"}, stg.gotText)
+	stg.zero()
+
+	// The bot is restarted
+	th := tg.New(target, str, nil, tg.WithSessionStore(store))
+
+	th.Process(update("/en"))
+	assert.Equal(t, []string{"go to step 2"}, stg.gotText, "want last responses translated after restart")
+	stg.zero()
+
+	th.Process(update("step 2"))
+	assert.Equal(t, []string{"finish"}, stg.gotText, "want step kept after restart")
+
+	sessions, err := store.List()
+	require.NoError(t, err)
+	assert.Equal(t, 2, sessions[5].Step)
+	assert.Equal(t, "en", sessions[5].Lang)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	str := story.New().
+		Add(story.NewStep().As("loop").Expect("tick").Respond("tock").Set("count += 1").Goto("loop").Fail("tick?"))
+
+	store := session.NewMemory()
+	th := tg.New(target, str, nil, tg.WithSessionStore(store))
+
+	const chats, ticks = 10, 20
+	body := func(id int) []byte {
+		b, err := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: id}, Text: "tick"}})
+		require.NoError(t, err)
+		return b
+	}
+
+	var wg sync.WaitGroup
+	for id := 1; id <= chats; id++ {
+		for i := 0; i < ticks; i++ {
+			wg.Add(1)
+			go func(b []byte) {
+				defer wg.Done()
+				th.ServeHTTP(httptest.NewRecorder(), newUpdateRequest(b))
+			}(body(id))
+		}
+	}
+	wg.Wait()
+	th.Wait()
+
+	assert.Len(t, stg.texts(), chats*ticks)
+
+	sessions, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, sessions, chats)
+	for id, sess := range sessions {
+		assert.Equal(t, ticks, sess.Vars["count"], "want no updates of chat %d lost", id)
+	}
+}
+
+func TestButtons(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	str := story.New().
+		Add(story.NewStep().Expect("begin").Respond("door or window?").Fail("begin?")).
+		Add(story.NewStep().Expect("door").Buttons([]string{"door", "window"}).Respond("open it?").Fail("door or window?")).
+		Add(story.NewStep().Expect("yes").InlineButtons([]string{"yes"}, []string{"no"}).Respond("opened").Fail("open it?"))
+
+	th := tg.New(target, str, nil)
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 3}, Text: "begin"}})
+	require.Len(t, stg.gotMarkup, 1)
+	assert.Equal(t, map[string]interface{}{
+		"keyboard":          []interface{}{[]interface{}{map[string]interface{}{"text": "door"}, map[string]interface{}{"text": "window"}}},
+		"resize_keyboard":   true,
+		"one_time_keyboard": true,
+	}, stg.gotMarkup[0], "want reply keyboard of the next step")
+	stg.zero()
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 3}, Text: "door"}})
+	require.Len(t, stg.gotMarkup, 1)
+	assert.Equal(t, map[string]interface{}{
+		"inline_keyboard": []interface{}{
+			[]interface{}{map[string]interface{}{"text": "yes", "callback_data": "yes"}},
+			[]interface{}{map[string]interface{}{"text": "no", "callback_data": "no"}},
+		},
+	}, stg.gotMarkup[0], "want inline keyboard of the next step")
+	stg.zero()
+
+	th.Process(tg.Update{CallbackQuery: &tg.CallbackQuery{
+		ID:      "query-1",
+		Message: &tg.Message{Chat: tg.Chat{ID: 3}},
+		Data:    "yes",
+	}})
+	assert.Equal(t, []string{"/answerCallbackQuery", "/sendMessage"}, stg.gotPath)
+	assert.Equal(t, []string{"query-1", "opened"}, stg.gotText, "want pressed button answered and processed as a message")
+	assert.Equal(t, 3, stg.gotChatID[1])
+	assert.Equal(t, []interface{}{nil}, stg.gotMarkup, "want no keyboard for the step without buttons")
+}
+
+func TestBranchingSteps(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().
+			Fail("left or right?").
+			Branch(
+				story.NewBranch().Expect("left").Goto("garden").Respond("to the garden"),
+				story.NewBranch().Expect("right").Goto("cellar").Respond("to the cellar"),
+			)).
+		Add(story.NewStep().As("garden").Expect("look").Respond("flowers").Fail("still in the garden")).
+		Add(story.NewStep().As("cellar").Expect("look").Respond("darkness").Fail("still in the cellar")).
+		AddCommand(story.NewStep().Expect("cellar").Respond("rehearsing the cellar").Goto("cellar"))
+
+	assertChat(t, str, []chatTurn{
+		{1, "right", "to the cellar"},
+		{2, "left", "to the garden"},
+		{1, "look", "darkness"},
+		{2, "look", "flowers"},
+		{2, "/cellar", "rehearsing the cellar"},
+		{2, "look", "darkness"},
+	}, "want response of the branch")
+}
+
+func TestStoryVariables(t *testing.T) {
+	str := story.New().
+		AddCommand(story.NewStep().Expect("start").Respond("started")).
+		Add(story.NewStep().
+			Fail("left or right?").
+			Branch(
+				story.NewBranch().Expect("left").Set("visited_garden = true").Respond("to the garden"),
+				story.NewBranch().Expect("right").Respond("to the cellar"),
+			)).
+		Add(story.NewStep().
+			Expect("open").
+			Respond("bad ending").
+			Branch(story.NewBranch().When("visited_garden").Respond("good ending")))
+
+	assertChat(t, str, []chatTurn{
+		{1, "left", "to the garden"},
+		{2, "right", "to the cellar"},
+		{1, "open", "good ending"},
+		{2, "open", "bad ending"},
+		{1, "/start", "started"},
+		{1, "right", "to the cellar"},
+		{1, "open", "bad ending"},
+	}, "want response depending on user choices")
+}
+
+func TestHintsOnConsecutiveFails(t *testing.T) {
+	str := story.New().
+		Add(story.NewStep().Expect("rose").Respond("right").Hint("think", "red", "rose").AdvanceAfter(4)).
+		Add(story.NewStep().Expect("tulip").Respond("right again").Hint("yellow"))
+
+	assertChat(t, str, []chatTurn{
+		{1, "daisy", "think"},
+		{1, "daisy", "red"},
+		{2, "daisy", "think"},
+		{1, "/en", "Language changed"},
+		{1, "daisy", "rose"},
+		{1, "daisy", "right"},
+		{1, "daisy", "yellow"},
+		{2, "rose", "right"},
+		{2, "daisy", "yellow"},
+		{2, "tulip", "right again"},
+		{2, "daisy", "think"},
+		{2, "daisy", "red"},
+	}, "want hint depending on failed attempts")
+}
+
 func TestLogging(t *testing.T) {
 	stg := stubTgServer{}
 	close, target := stg.tgServerMockURL()
@@ -275,8 +593,9 @@ func TestLogging(t *testing.T) {
 	body, _ := json.Marshal(obj)
 
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+	r := newUpdateRequest(body)
 	th.ServeHTTP(w, r)
+	th.Wait()
 
 	assert.Contains(t, b.String(), "telegram update: ", "want logged message on receiving")
 	assert.Contains(t, b.String(), fmt.Sprintf("%#v", obj), "want logged update object on receiving")
@@ -310,10 +629,11 @@ func TestLanguageFromTgCode(t *testing.T) {
 	body, _ := json.Marshal(obj)
 
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+	r := newUpdateRequest(body)
 
 	th := tg.New(target, str, nil)
 	th.ServeHTTP(w, r)
+	th.Wait()
 
 	assert.Equal(t, "отлично", stg.gotText[0], "want immediately russian text because of language code")
 }
@@ -347,14 +667,15 @@ func TestLaterMessage(t *testing.T) {
 	body, _ := json.Marshal(obj)
 
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r := newUpdateRequest(body)
 	th.ServeHTTP(w, r)
+	th.Wait()
 
-	assert.Len(t, stg.gotText, 3)
+	assert.Len(t, stg.texts(), 3)
 
 	// TODO: Should not wait for real
 	time.Sleep(time.Millisecond * 202)
-	assert.Len(t, stg.gotText, 4)
+	assert.Len(t, stg.texts(), 4)
 }
 
 func TestCancelLaterMessage(t *testing.T) {
@@ -387,29 +708,111 @@ func TestCancelLaterMessage(t *testing.T) {
 	body, _ := json.Marshal(obj)
 
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r := newUpdateRequest(body)
 	th.ServeHTTP(w, r)
+	th.Wait()
 
-	assert.Len(t, stg.gotText, 3)
+	assert.Len(t, stg.texts(), 3)
 
 	w = httptest.NewRecorder()
-	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r = newUpdateRequest(body)
 	th.ServeHTTP(w, r)
-	time.Sleep(time.Millisecond * 1)
-
-	require.Len(t, stg.gotText, 4)
-	assert.Equal(t, "late but cancelled", stg.gotText[3])
+	th.Wait()
+	require.Eventually(t, func() bool { return len(stg.texts()) == 4 }, time.Second, time.Millisecond)
+	assert.Equal(t, "late but cancelled", stg.texts()[3])
 
 	// TODO: Should not wait for real
-	time.Sleep(time.Millisecond * 202)
-	require.Len(t, stg.gotText, 5)
-	assert.Equal(t, "even later", stg.gotText[4])
+	require.Eventually(t, func() bool { return len(stg.texts()) == 5 }, time.Second, time.Millisecond)
+	assert.Equal(t, "even later", stg.texts()[4])
 
 	w = httptest.NewRecorder()
-	r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r = newUpdateRequest(body)
 	th.ServeHTTP(w, r)
-	require.Len(t, stg.gotText, 6)
-	assert.Equal(t, "should be unreachable", stg.gotText[5])
+	th.Wait()
+	require.Len(t, stg.texts(), 6)
+	assert.Equal(t, "should be unreachable", stg.texts()[5])
+}
+
+func TestLaterMessagesPerUser(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	str := story.New().
+		Add(story.NewStep().
+			Expect("want late").
+			Respond("first", "late").
+			Fail("fail").
+			Additional(1, "time", time.Millisecond*100)).
+		Add(story.NewStep().
+			Expect("next").
+			Respond("at next step").
+			Fail("still waiting for next"))
+
+	th := tg.New(target, str, nil)
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "want late"}})
+	require.Len(t, stg.texts(), 1)
+	require.Len(t, th.PendingResponses(1), 1)
+	assert.Equal(t, "late", th.PendingResponses(1)[0].Text())
+	assert.Empty(t, th.PendingResponses(2))
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 2}, Text: "want late"}})
+	require.Len(t, stg.texts(), 2, "want another user not blocked by pending message")
+	assert.Equal(t, []int{1, 2}, stg.chatIDs())
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 2}, Text: "next"}})
+	require.Eventually(t, func() bool { return len(stg.texts()) == 3 }, time.Second, time.Millisecond, "want only own pending message skipped")
+	assert.Equal(t, "late", stg.texts()[2])
+	assert.Equal(t, 2, stg.chatIDs()[2])
+	assert.Empty(t, th.PendingResponses(2))
+	assert.Len(t, th.PendingResponses(1), 1)
+
+	assert.Equal(t, 1, th.CancelPending(1))
+	assert.Equal(t, 0, th.CancelPending(1))
+
+	time.Sleep(time.Millisecond * 150)
+	assert.Len(t, stg.texts(), 3, "want cancelled message not sent")
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "next"}})
+	require.Len(t, stg.texts(), 4)
+	assert.Equal(t, "at next step", stg.texts()[3])
+}
+
+func TestSecretToken(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	b := &bytes.Buffer{}
+	str := story.New().Add(story.NewStep().Expect("go").Respond("moved"))
+	th := tg.New(target, str, log.New(b, "", 0), tg.WithSecretToken("s3cret"))
+	body, _ := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "go"}})
+
+	tests := []struct {
+		name, token string
+		status      int
+		sent        int
+	}{
+		{"no token", "", http.StatusUnauthorized, 0},
+		{"wrong token", "guess", http.StatusUnauthorized, 0},
+		{"right token", "s3cret", http.StatusOK, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := newUpdateRequest(body)
+			if tt.token != "" {
+				r.Header.Set(tg.SecretTokenHeader, tt.token)
+			}
+			th.ServeHTTP(w, r)
+			th.Wait()
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.Len(t, stg.texts(), tt.sent, "want forged updates not processed")
+		})
+	}
+	assert.Contains(t, b.String(), "wrong secret token")
 }
 
 func TestWrongUpdateError(t *testing.T) {
@@ -417,10 +820,87 @@ func TestWrongUpdateError(t *testing.T) {
 	lgr := log.New(b, "", 0)
 	th := tg.New("", nil, lgr)
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r := newUpdateRequest(nil)
 	th.ServeHTTP(w, r)
 
 	assert.Equal(t, "receive error: EOF\n", b.String(), "want error message in body")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "want malformed update rejected")
+}
+
+func TestSessionErrorWithoutLogger(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	str := story.New().Add(story.NewStep().Expect("go").Respond("moved"))
+	th := tg.New(target, str, nil, tg.WithSessionStore(brokenStore{}))
+
+	body, _ := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 12}, Text: "go"}})
+	w := httptest.NewRecorder()
+	assert.NotPanics(t, func() {
+		th.ServeHTTP(w, newUpdateRequest(body))
+		th.Wait()
+	}, "want session error skipped without a logger")
+	assert.Empty(t, stg.gotText, "want nothing sent without a session")
+}
+
+func TestStepWithoutResponses(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	b := &bytes.Buffer{}
+	str := story.New().Add(story.NewStep().Expect("go"))
+	th := tg.New(target, str, log.New(b, "", 0))
+
+	body, _ := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 12}, Text: "go"}})
+	th.ServeHTTP(httptest.NewRecorder(), newUpdateRequest(body))
+	th.Wait()
+
+	assert.Empty(t, stg.gotText)
+	assert.Contains(t, b.String(), `no responses to "go"`)
+}
+
+func TestPanicWhileProcessing(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	b := &bytes.Buffer{}
+	str := story.New().Add(story.NewStep().Expect("go").Respond("moved"))
+	th := tg.New(target, str, log.New(b, "", 0), tg.WithSessionStore(panickingStore{}))
+
+	body, _ := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 12}, Text: "go"}})
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		th.ServeHTTP(w, newUpdateRequest(body))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	th.Wait()
+
+	assert.Equal(t, 2, strings.Count(b.String(), "process update panic: store is broken"), "want every update of the chat processed")
+}
+
+// panickingStore panics on any call
+type panickingStore struct{ brokenStore }
+
+func (panickingStore) Load(id int) (session.Session, error) {
+	panic("store is broken")
+}
+
+// brokenStore fails to load and save any session
+type brokenStore struct{}
+
+func (brokenStore) Load(id int) (session.Session, error) {
+	return session.Session{}, errors.New("disk is gone")
+}
+
+func (brokenStore) Save(id int, s session.Session) error {
+	return errors.New("disk is gone")
+}
+
+func (brokenStore) List() (map[int]session.Session, error) {
+	return nil, errors.New("disk is gone")
 }
 
 func TestChatActionError(t *testing.T) {
@@ -446,36 +926,77 @@ func TestChatActionError(t *testing.T) {
 	body, _ := json.Marshal(obj)
 
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r := newUpdateRequest(body)
 	th.ServeHTTP(w, r)
+	th.Wait()
 
 	assert.Contains(t, b.String(), "stopped after 10 redirects", "want error message in body")
 }
 
-// func TestTelegramError(t *testing.T) {
-// 	stg := &stubTgServer{}
-// 	close, target := stg.tgServerErrMockURL()
-// 	defer close()
+func TestTelegramError(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerErrMockURL()
+	defer close()
+
+	str := story.New().Add(story.NewStep().Expect("smth").Respond("good"))
+	th := tg.New(target, str, nil, retrying(target, tg.Retry{Attempts: 3, Backoff: time.Millisecond}))
+
+	obj := tg.Update{
+		Message: tg.Message{
+			Chat: tg.Chat{
+				ID: 333,
+			},
+			Text: "smth",
+		},
+	}
+	body, _ := json.Marshal(obj)
+	w := httptest.NewRecorder()
+	r := newUpdateRequest(body)
+	th.ServeHTTP(w, r)
+	th.Wait()
+
+	require.Len(t, stg.gotText, 1, "should receive answer after error")
+	assert.Equal(t, "good", stg.gotText[0])
+	assert.Len(t, stg.gotPath, 3, "want failed requests retried")
+}
 
-// 	str := story.New().Add(story.NewStep().Expect("smth").Respond("good"))
-// 	th := tg.New(target, str, nil)
+// chatTurn is a message of a user and the only response the user should get to it
+type chatTurn struct {
+	id       int
+	message  string
+	response string
+}
+
+// assertChat sends the messages to a handler of the story one by one, each from its user,
+// and asserts the response to each of them
+func assertChat(t *testing.T, str *story.Story, turns []chatTurn, msg string) {
+	t.Helper()
+
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
 
-// 	obj := tg.Update{
-// 		Message: tg.Message{
-// 			Chat: tg.Chat{
-// 				ID: 333,
-// 			},
-// 			Text: "smth",
-// 		},
-// 	}
-// 	body, _ := json.Marshal(obj)
-// 	w := httptest.NewRecorder()
-// 	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
-// 	th.ServeHTTP(w, r)
+	th := tg.New(target, str, nil)
 
-// 	require.Len(t, stg.gotText, 1, "should receive answer after error")
-// 	assert.Equal(t, "good", stg.gotText[0])
-// }
+	for _, tt := range turns {
+		t.Run(fmt.Sprintf("User %d: %q", tt.id, tt.message), func(t *testing.T) {
+			body, _ := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: tt.id}, Text: tt.message}})
+			th.ServeHTTP(httptest.NewRecorder(), newUpdateRequest(body))
+			th.Wait()
+
+			require.Len(t, stg.gotText, 1)
+			assert.Equal(t, tt.response, stg.gotText[0], msg)
+			stg.zero()
+		})
+	}
+}
+
+// newUpdateRequest makes a request of Telegram posting the update to the webhook
+func newUpdateRequest(body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
 
 func (s *stubTgServer) tgServerAlwaysRedir() (func(), string) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -485,38 +1006,46 @@ func (s *stubTgServer) tgServerAlwaysRedir() (func(), string) {
 	return srv.Close, srv.URL
 }
 
-// func (s *stubTgServer) tgServerErrMockURL() (func(), string) {
-// 	i := 0
-// 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		mux := http.NewServeMux()
-// 		s.gotPath = append(s.gotPath, r.URL.Path)
-// 		fillData := func(id int, text string, r *http.Request) {
-// 			s.gotHeader = append(s.gotHeader, r.Header.Get("Content-Type"))
-// 			s.gotChatID = append(s.gotChatID, id)
-// 			s.gotText = append(s.gotText, text)
-// 		}
-// 		mux.HandleFunc("/sendMessage", func(w http.ResponseWriter, r *http.Request) {
-// 			var m tg.SendMessage
-// 			json.NewDecoder(r.Body).Decode(&m)
-// 			fillData(m.ChatID, m.Text, r)
-// 		})
-
-// 		i++
-// 		if i > 3 {
-// 			mux.ServeHTTP(w, r)
-// 			return
-// 		}
-
-// 		http.Error(w, "telegram error", http.StatusInternalServerError)
-// 	}))
-
-// 	return srv.Close, srv.URL
-// }
+// tgServerErrMockURL answers with server errors to the first two requests
+func (s *stubTgServer) tgServerErrMockURL() (func(), string) {
+	i := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux := http.NewServeMux()
+		s.gotPath = append(s.gotPath, r.URL.Path)
+		fillData := func(id int, text string, r *http.Request) {
+			s.gotHeader = append(s.gotHeader, r.Header.Get("Content-Type"))
+			s.gotChatID = append(s.gotChatID, id)
+			s.gotText = append(s.gotText, text)
+		}
+		mux.HandleFunc("/sendMessage", func(w http.ResponseWriter, r *http.Request) {
+			var m tg.SendMessage
+			json.NewDecoder(r.Body).Decode(&m)
+			fillData(m.ChatID, m.Text, r)
+			w.Write([]byte(`{"ok":true,"result":{}}`))
+		})
+
+		i++
+		if i > 2 {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		http.Error(w, "telegram error", http.StatusInternalServerError)
+	}))
+
+	return srv.Close, srv.URL
+}
 
 func (s *stubTgServer) tgServerMockURL() (func(), string) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
 		mux := http.NewServeMux()
 		s.gotPath = append(s.gotPath, r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		s.gotBody = append(s.gotBody, string(body))
+		r.Body = io.NopCloser(bytes.NewReader(body))
 		fillData := func(id int, text string, r *http.Request) {
 			s.gotHeader = append(s.gotHeader, r.Header.Get("Content-Type"))
 			s.gotChatID = append(s.gotChatID, id)
@@ -526,6 +1055,12 @@ func (s *stubTgServer) tgServerMockURL() (func(), string) {
 			var m tg.SendMessage
 			_ = json.NewDecoder(r.Body).Decode(&m)
 			fillData(m.ChatID, m.Text, r)
+			s.gotMarkup = append(s.gotMarkup, m.ReplyMarkup)
+		})
+		mux.HandleFunc("/answerCallbackQuery", func(w http.ResponseWriter, r *http.Request) {
+			var m tg.AnswerCallbackQuery
+			_ = json.NewDecoder(r.Body).Decode(&m)
+			fillData(0, m.CallbackQueryID, r)
 		})
 		mux.HandleFunc("/sendAudio", func(w http.ResponseWriter, r *http.Request) {
 			var m tg.SendAudio
@@ -543,16 +1078,44 @@ func (s *stubTgServer) tgServerMockURL() (func(), string) {
 			_ = json.NewDecoder(r.Body).Decode(&m)
 			fillData(m.ChatID, m.Action, r)
 		})
+		// Other endpoints are recorded with the whole body as text
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			var m map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&m)
+			id, _ := m["chat_id"].(float64)
+			b, _ := json.Marshal(m)
+			fillData(int(id), string(b), r)
+		})
 
 		mux.ServeHTTP(w, r)
+		w.Write([]byte(`{"ok":true,"result":true}`))
 	}))
 
 	return srv.Close, srv.URL
 }
 
+// texts returns texts received so far, it is safe to call while responses are sent in background
+func (s *stubTgServer) texts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.gotText...)
+}
+
+// chatIDs returns chat IDs received so far, it is safe to call while responses are sent in background
+func (s *stubTgServer) chatIDs() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.gotChatID...)
+}
+
 func (s *stubTgServer) zero() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.gotChatID = []int{}
 	s.gotHeader = []string{}
 	s.gotPath = []string{}
 	s.gotText = []string{}
+	s.gotMarkup = []interface{}{}
+	s.gotBody = []string{}
 }
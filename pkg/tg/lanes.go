@@ -0,0 +1,69 @@
+package tg
+
+import "sync"
+
+// lane lets updates of one chat be processed one at a time in the order they came
+type lane struct {
+	cond    *sync.Cond
+	next    uint64 // ticket of the next update to come
+	serving uint64 // ticket of the update being processed
+	users   int    // updates which are waiting or being processed
+}
+
+// lanes serializes processing of each chat, while different chats are processed in parallel
+type lanes struct {
+	mu    sync.Mutex
+	chats map[int]*lane
+}
+
+func newLanes() *lanes {
+	return &lanes{chats: make(map[int]*lane)}
+}
+
+// enter waits until all earlier updates of the chat are processed.
+// The returned function should be called when the update is processed.
+func (ls *lanes) enter(id int) func() {
+	return ls.queue(id)()
+}
+
+// queue takes the place of the update in the chat without waiting.
+// The returned function waits for the turn and returns the function
+// which should be called when the update is processed.
+func (ls *lanes) queue(id int) func() func() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.chats[id]
+	if !ok {
+		l = &lane{cond: sync.NewCond(&ls.mu)}
+		ls.chats[id] = l
+	}
+	ticket := l.next
+	l.next++
+	l.users++
+
+	return func() func() {
+		ls.mu.Lock()
+		for l.serving != ticket {
+			l.cond.Wait()
+		}
+		ls.mu.Unlock()
+
+		return ls.leave(id, l)
+	}
+}
+
+// leave returns the function letting the next update of the chat be processed
+func (ls *lanes) leave(id int, l *lane) func() {
+	return func() {
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+
+		l.serving++
+		l.users--
+		if l.users == 0 {
+			delete(ls.chats, id)
+		}
+		l.cond.Broadcast()
+	}
+}
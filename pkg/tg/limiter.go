@@ -0,0 +1,120 @@
+package tg
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultGlobalRate is how many messages per second Telegram allows a bot to send to all chats
+	DefaultGlobalRate = 30
+	// DefaultChatRate is how many messages per second Telegram allows a bot to send to one chat
+	DefaultChatRate = 1
+)
+
+// Limiter keeps outgoing messages within Telegram limits: overall and for each chat.
+// Every message gets its own time slot, so a chat waiting for its limit
+// does not hold back messages to other chats, and messages of a chat keep their order.
+type Limiter struct {
+	mu     sync.Mutex
+	clock  Clock
+	global time.Duration     // global is the time between any two messages
+	chat   time.Duration     // chat is the time between two messages to one chat
+	slots  []time.Time       // slots are times given to messages, sorted
+	chats  map[int]time.Time // chats are the earliest times for the next message to each chat
+
+	waiting int64
+}
+
+// WithLimiter makes the Handler wait for the Limiter before sending every response.
+// By default responses are sent without limits.
+func WithLimiter(l *Limiter) Option {
+	return func(h *Handler) {
+		h.limiter = l
+	}
+}
+
+// NewLimiter creates a Limiter allowing global messages per second to all chats
+// and chat messages per second to each chat
+func NewLimiter(c Clock, global, chat float64) *Limiter {
+	return &Limiter{
+		clock:  c,
+		global: time.Duration(float64(time.Second) / global),
+		chat:   time.Duration(float64(time.Second) / chat),
+		chats:  make(map[int]time.Time),
+	}
+}
+
+// Wait blocks until a message can be sent to the chat.
+// A nil Limiter does not wait.
+func (l *Limiter) Wait(id int) {
+	if l == nil {
+		return
+	}
+
+	d := l.reserve(id)
+	if d <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	l.clock.AfterFunc(d, func() { close(done) })
+
+	atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+	<-done
+}
+
+// Depth returns how many messages are waiting to be sent
+func (l *Limiter) Depth() int {
+	if l == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&l.waiting))
+}
+
+// reserve gives the message to the chat the earliest slot which is free for the chat and globally,
+// and returns how long to wait for it
+func (l *Limiter) reserve(id int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.forget(now)
+
+	t := now
+	if next, ok := l.chats[id]; ok && next.After(t) {
+		t = next
+	}
+	// Slots are sorted, so moving past a taken slot never comes back to an earlier one
+	for _, s := range l.slots {
+		if s.After(t.Add(-l.global)) && s.Before(t.Add(l.global)) {
+			t = s.Add(l.global)
+		}
+	}
+
+	i := sort.Search(len(l.slots), func(i int) bool { return l.slots[i].After(t) })
+	l.slots = append(l.slots, time.Time{})
+	copy(l.slots[i+1:], l.slots[i:])
+	l.slots[i] = t
+	l.chats[id] = t.Add(l.chat)
+
+	return t.Sub(now)
+}
+
+// forget removes slots and chats which cannot affect messages from now on
+func (l *Limiter) forget(now time.Time) {
+	past := 0
+	for past < len(l.slots) && !l.slots[past].After(now.Add(-l.global)) {
+		past++
+	}
+	l.slots = l.slots[past:]
+
+	for id, next := range l.chats {
+		if !next.After(now) {
+			delete(l.chats, id)
+		}
+	}
+}
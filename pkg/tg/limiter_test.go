@@ -0,0 +1,84 @@
+package tg_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/asahnoln/mesproc/pkg/tg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	c := newFakeClock()
+	l := tg.NewLimiter(c, 10, 1)
+	done := make(chan string, 10)
+
+	// wait waits for the limiter in background and makes sure it is waiting before the next call
+	wait := func(id int, name string, depth int) {
+		go func() {
+			l.Wait(id)
+			done <- name
+		}()
+		require.Eventually(t, func() bool { return l.Depth() == depth }, time.Second, time.Millisecond)
+	}
+	next := func() string {
+		select {
+		case name := <-done:
+			return name
+		case <-time.After(time.Second):
+			return "nothing"
+		}
+	}
+
+	l.Wait(1)
+	wait(1, "second to 1", 1)
+	wait(2, "first to 2", 2)
+	wait(3, "first to 3", 3)
+
+	c.Advance(time.Millisecond * 100)
+	assert.Equal(t, "first to 2", next(), "want other chats not waiting for the limit of the chat")
+	c.Advance(time.Millisecond * 100)
+	assert.Equal(t, "first to 3", next(), "want global limit between messages")
+	c.Advance(time.Millisecond * 800)
+	assert.Equal(t, "second to 1", next(), "want chat limit between messages to the chat")
+	assert.Eventually(t, func() bool { return l.Depth() == 0 }, time.Second, time.Millisecond)
+
+	// Later messages do not wait for slots in the past
+	c.Advance(time.Second)
+	l.Wait(1)
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *tg.Limiter
+	l.Wait(1)
+	assert.Equal(t, 0, l.Depth())
+}
+
+func TestHandlerWithLimiter(t *testing.T) {
+	stg := &stubTgServer{}
+	stop, target := stg.tgServerMockURL()
+	defer stop()
+
+	c := newFakeClock()
+	l := tg.NewLimiter(c, tg.DefaultGlobalRate, tg.DefaultChatRate)
+	str := story.New().Add(story.NewStep().Expect("go").Respond("one", "two", "three"))
+	th := tg.New(target, str, nil, tg.WithLimiter(l))
+
+	processed := make(chan struct{})
+	go func() {
+		th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "go"}})
+		close(processed)
+	}()
+
+	for i := 1; i <= 3; i++ {
+		require.Eventually(t, func() bool { return len(stg.texts()) == i }, time.Second, time.Millisecond)
+		if i < 3 {
+			require.Eventually(t, func() bool { return l.Depth() == 1 }, time.Second, time.Millisecond)
+			c.Advance(time.Second)
+		}
+	}
+	<-processed
+	assert.Equal(t, []string{"one", "two", "three"}, stg.texts(), "want responses in order")
+}
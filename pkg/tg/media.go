@@ -0,0 +1,410 @@
+package tg
+
+import (
+	"github.com/asahnoln/mesproc/pkg/story"
+)
+
+// SendVoice is an object used to send a voice note to a bot
+type SendVoice struct {
+	ChatID      int         `json:"chat_id"`
+	Voice       string      `json:"voice"`
+	Caption     string      `json:"caption,omitempty"`
+	ParseMode   string      `json:"parse_mode,omitempty"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
+}
+
+// SendVideo is an object used to send a video to a bot
+type SendVideo struct {
+	ChatID      int         `json:"chat_id"`
+	Video       string      `json:"video"`
+	Caption     string      `json:"caption,omitempty"`
+	ParseMode   string      `json:"parse_mode,omitempty"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
+}
+
+// SendVideoNote is an object used to send a round video note to a bot
+type SendVideoNote struct {
+	ChatID      int         `json:"chat_id"`
+	VideoNote   string      `json:"video_note"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
+}
+
+// SendDocument is an object used to send a document like a PDF to a bot
+type SendDocument struct {
+	ChatID      int         `json:"chat_id"`
+	Document    string      `json:"document"`
+	Caption     string      `json:"caption,omitempty"`
+	ParseMode   string      `json:"parse_mode,omitempty"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
+}
+
+// SendAnimation is an object used to send an animation like a GIF to a bot
+type SendAnimation struct {
+	ChatID      int         `json:"chat_id"`
+	Animation   string      `json:"animation"`
+	Caption     string      `json:"caption,omitempty"`
+	ParseMode   string      `json:"parse_mode,omitempty"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
+}
+
+// SendSticker is an object used to send a sticker to a bot
+type SendSticker struct {
+	ChatID      int         `json:"chat_id"`
+	Sticker     string      `json:"sticker"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
+}
+
+// SendLocation is an object used to send a location pin to a bot
+type SendLocation struct {
+	ChatID      int         `json:"chat_id"`
+	Latitude    float64     `json:"latitude"`
+	Longitude   float64     `json:"longitude"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
+	err         error
+}
+
+// SendVenue is an object used to send a location pin with a title and an address to a bot
+type SendVenue struct {
+	ChatID      int         `json:"chat_id"`
+	Latitude    float64     `json:"latitude"`
+	Longitude   float64     `json:"longitude"`
+	Title       string      `json:"title"`
+	Address     string      `json:"address"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
+	err         error
+}
+
+// SetChatID sets chat ID for current sender
+func (s *SendVoice) SetChatID(i int) {
+	s.ChatID = i
+}
+
+// SetContent sets content for current sender
+func (s *SendVoice) SetContent(a string) {
+	s.Voice = a
+}
+
+// SetCaption sets a caption for current sender
+func (s *SendVoice) SetCaption(c string) {
+	s.Caption = c
+}
+
+// SetParseMode sets a parse mode for current sender
+func (s *SendVoice) SetParseMode(m string) {
+	s.ParseMode = m
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendVoice) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// FileField returns the name of the field with the file
+func (s *SendVoice) FileField() string {
+	return "voice"
+}
+
+// File returns the file to send
+func (s *SendVoice) File() string {
+	return s.Voice
+}
+
+// URL returns Telegram endpoint to process current sender
+func (s *SendVoice) URL() string {
+	return "/sendVoice"
+}
+
+func (s *SendVoice) GetChatID() int {
+	return s.ChatID
+}
+
+func (s *SendVoice) ChatAction() string {
+	return "upload_voice"
+}
+
+// SetChatID sets chat ID for current sender
+func (s *SendVideo) SetChatID(i int) {
+	s.ChatID = i
+}
+
+// SetContent sets content for current sender
+func (s *SendVideo) SetContent(a string) {
+	s.Video = a
+}
+
+// SetCaption sets a caption for current sender
+func (s *SendVideo) SetCaption(c string) {
+	s.Caption = c
+}
+
+// SetParseMode sets a parse mode for current sender
+func (s *SendVideo) SetParseMode(m string) {
+	s.ParseMode = m
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendVideo) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// FileField returns the name of the field with the file
+func (s *SendVideo) FileField() string {
+	return "video"
+}
+
+// File returns the file to send
+func (s *SendVideo) File() string {
+	return s.Video
+}
+
+// URL returns Telegram endpoint to process current sender
+func (s *SendVideo) URL() string {
+	return "/sendVideo"
+}
+
+func (s *SendVideo) GetChatID() int {
+	return s.ChatID
+}
+
+func (s *SendVideo) ChatAction() string {
+	return "upload_video"
+}
+
+// SetChatID sets chat ID for current sender
+func (s *SendVideoNote) SetChatID(i int) {
+	s.ChatID = i
+}
+
+// SetContent sets content for current sender
+func (s *SendVideoNote) SetContent(a string) {
+	s.VideoNote = a
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendVideoNote) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// FileField returns the name of the field with the file
+func (s *SendVideoNote) FileField() string {
+	return "video_note"
+}
+
+// File returns the file to send
+func (s *SendVideoNote) File() string {
+	return s.VideoNote
+}
+
+// URL returns Telegram endpoint to process current sender
+func (s *SendVideoNote) URL() string {
+	return "/sendVideoNote"
+}
+
+func (s *SendVideoNote) GetChatID() int {
+	return s.ChatID
+}
+
+func (s *SendVideoNote) ChatAction() string {
+	return "upload_video_note"
+}
+
+// SetChatID sets chat ID for current sender
+func (s *SendDocument) SetChatID(i int) {
+	s.ChatID = i
+}
+
+// SetContent sets content for current sender
+func (s *SendDocument) SetContent(a string) {
+	s.Document = a
+}
+
+// SetCaption sets a caption for current sender
+func (s *SendDocument) SetCaption(c string) {
+	s.Caption = c
+}
+
+// SetParseMode sets a parse mode for current sender
+func (s *SendDocument) SetParseMode(m string) {
+	s.ParseMode = m
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendDocument) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// FileField returns the name of the field with the file
+func (s *SendDocument) FileField() string {
+	return "document"
+}
+
+// File returns the file to send
+func (s *SendDocument) File() string {
+	return s.Document
+}
+
+// URL returns Telegram endpoint to process current sender
+func (s *SendDocument) URL() string {
+	return "/sendDocument"
+}
+
+func (s *SendDocument) GetChatID() int {
+	return s.ChatID
+}
+
+func (s *SendDocument) ChatAction() string {
+	return "upload_document"
+}
+
+// SetChatID sets chat ID for current sender
+func (s *SendAnimation) SetChatID(i int) {
+	s.ChatID = i
+}
+
+// SetContent sets content for current sender
+func (s *SendAnimation) SetContent(a string) {
+	s.Animation = a
+}
+
+// SetCaption sets a caption for current sender
+func (s *SendAnimation) SetCaption(c string) {
+	s.Caption = c
+}
+
+// SetParseMode sets a parse mode for current sender
+func (s *SendAnimation) SetParseMode(m string) {
+	s.ParseMode = m
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendAnimation) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// FileField returns the name of the field with the file
+func (s *SendAnimation) FileField() string {
+	return "animation"
+}
+
+// File returns the file to send
+func (s *SendAnimation) File() string {
+	return s.Animation
+}
+
+// URL returns Telegram endpoint to process current sender
+func (s *SendAnimation) URL() string {
+	return "/sendAnimation"
+}
+
+func (s *SendAnimation) GetChatID() int {
+	return s.ChatID
+}
+
+func (s *SendAnimation) ChatAction() string {
+	return "upload_video"
+}
+
+// SetChatID sets chat ID for current sender
+func (s *SendSticker) SetChatID(i int) {
+	s.ChatID = i
+}
+
+// SetContent sets content for current sender
+func (s *SendSticker) SetContent(a string) {
+	s.Sticker = a
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendSticker) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// FileField returns the name of the field with the file
+func (s *SendSticker) FileField() string {
+	return "sticker"
+}
+
+// File returns the file to send
+func (s *SendSticker) File() string {
+	return s.Sticker
+}
+
+// URL returns Telegram endpoint to process current sender
+func (s *SendSticker) URL() string {
+	return "/sendSticker"
+}
+
+func (s *SendSticker) GetChatID() int {
+	return s.ChatID
+}
+
+func (s *SendSticker) ChatAction() string {
+	return "choose_sticker"
+}
+
+// SetChatID sets chat ID for current sender
+func (s *SendLocation) SetChatID(i int) {
+	s.ChatID = i
+}
+
+// SetContent sets content for current sender
+func (s *SendLocation) SetContent(a string) {
+	s.Latitude, s.Longitude, s.err = story.ParseLocation(a)
+}
+
+// ContentErr returns the error of the coordinates set by SetContent
+func (s *SendLocation) ContentErr() error {
+	return s.err
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendLocation) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// URL returns Telegram endpoint to process current sender
+func (s *SendLocation) URL() string {
+	return "/sendLocation"
+}
+
+func (s *SendLocation) GetChatID() int {
+	return s.ChatID
+}
+
+func (s *SendLocation) ChatAction() string {
+	return "find_location"
+}
+
+// SetChatID sets chat ID for current sender
+func (s *SendVenue) SetChatID(i int) {
+	s.ChatID = i
+}
+
+// SetContent sets content for current sender
+func (s *SendVenue) SetContent(a string) {
+	v, err := story.ParseVenue(a)
+	s.Latitude, s.Longitude, s.Title, s.Address, s.err = v.Latitude, v.Longitude, v.Title, v.Address, err
+}
+
+// ContentErr returns the error of the venue set by SetContent
+func (s *SendVenue) ContentErr() error {
+	return s.err
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendVenue) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// URL returns Telegram endpoint to process current sender
+func (s *SendVenue) URL() string {
+	return "/sendVenue"
+}
+
+func (s *SendVenue) GetChatID() int {
+	return s.ChatID
+}
+
+func (s *SendVenue) ChatAction() string {
+	return "find_location"
+}
@@ -0,0 +1,119 @@
+package tg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// confirmTimeout limits the call confirming received updates when the Poller stops
+const confirmTimeout = 10 * time.Second
+
+// Poller receives updates from a bot by long polling and passes them to a Handler.
+// It is an alternative to serving the Handler as a webhook, which requires a public address and TLS.
+type Poller struct {
+	h       *Handler
+	timeout time.Duration
+	offset  int
+	// confirmed is the offset Telegram surely got, updates before it are not received again
+	confirmed int
+	client    *Client
+	lgr       *log.Logger
+	retry     time.Duration
+}
+
+// NewPoller creates a Poller, which waits for updates up to timeout on each request.
+// It calls Telegram with the Client of the Handler, giving its requests enough time to wait.
+func NewPoller(h *Handler, timeout time.Duration, logger *log.Logger) *Poller {
+	c := *h.client
+	hc := http.Client{}
+	if c.HTTP != nil {
+		hc = *c.HTTP
+	}
+	hc.Timeout = timeout + 10*time.Second
+	c.HTTP = &hc
+
+	return &Poller{
+		h:       h,
+		timeout: timeout,
+		client:  &c,
+		lgr:     logger,
+		retry:   time.Second,
+	}
+}
+
+// Offset returns ID of the next update the Poller is waiting for
+func (p *Poller) Offset() int {
+	return p.offset
+}
+
+// Run polls updates until the context is done. Failed requests are logged and retried.
+// Updates are processed in background like by ServeHTTP: updates of one chat one by one,
+// updates of different chats in parallel.
+// When the context is done, Run waits until received updates are processed and confirms them to Telegram,
+// so they are not received again after restart. It returns nil when stopped by the context.
+func (p *Poller) Run(ctx context.Context) error {
+	defer p.stop()
+
+	for {
+		us, err := p.poll(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			p.logf("poll error: %v", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(p.retry):
+			}
+			continue
+		}
+
+		for _, u := range us {
+			p.h.dispatch(u)
+			p.offset = u.UpdateID + 1
+		}
+	}
+}
+
+func (p *Poller) poll(ctx context.Context) ([]Update, error) {
+	offset := p.offset
+	us, err := p.client.GetUpdates(ctx, GetUpdates{
+		Offset:         offset,
+		Timeout:        int(p.timeout / time.Second),
+		AllowedUpdates: AllowedUpdates,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tg: poll: %w", err)
+	}
+
+	p.confirmed = offset
+	return us, nil
+}
+
+// stop waits until received updates are processed and confirms them without waiting for new updates
+func (p *Poller) stop() {
+	p.h.Wait()
+	if p.offset == p.confirmed {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+	_, err := p.client.GetUpdates(ctx, GetUpdates{Offset: p.offset, AllowedUpdates: AllowedUpdates})
+	if err != nil {
+		p.logf("confirm error: %v", err)
+		return
+	}
+	p.confirmed = p.offset
+}
+
+func (p *Poller) logf(format string, v ...interface{}) {
+	if p.lgr != nil {
+		p.lgr.Printf(format, v...)
+	}
+}
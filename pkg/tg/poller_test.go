@@ -0,0 +1,164 @@
+package tg_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/asahnoln/mesproc/pkg/tg"
+	"github.com/asahnoln/mesproc/pkg/tg/tgtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubPollServer struct {
+	mu        sync.Mutex
+	updates   [][]tg.Update
+	gotOffset []int
+	gotText   []string
+	failFirst bool
+}
+
+func (s *stubPollServer) server(done func()) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/getUpdates":
+			var gu tg.GetUpdates
+			_ = json.NewDecoder(r.Body).Decode(&gu)
+
+			if s.failFirst {
+				s.failFirst = false
+				_, _ = w.Write([]byte(`{"ok": false, "description": "Conflict"}`))
+				return
+			}
+
+			s.gotOffset = append(s.gotOffset, gu.Offset)
+			if len(s.updates) == 0 {
+				done()
+				_, _ = w.Write([]byte(`{"ok": true, "result": []}`))
+				return
+			}
+
+			us := s.updates[0]
+			s.updates = s.updates[1:]
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": us})
+		case "/sendMessage":
+			var m tg.SendMessage
+			_ = json.NewDecoder(r.Body).Decode(&m)
+			s.gotText = append(s.gotText, m.Text)
+			_, _ = w.Write([]byte(`{"ok": true, "result": {}}`))
+		}
+	}))
+}
+
+func TestPoller(t *testing.T) {
+	stp := &stubPollServer{
+		failFirst: true,
+		updates: [][]tg.Update{
+			{
+				{UpdateID: 10, Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "hello"}},
+				{UpdateID: 11, Message: tg.Message{Chat: tg.Chat{ID: 2}, Text: "wrong"}},
+			},
+			{
+				{UpdateID: 12, Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "bye"}},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := stp.server(cancel)
+	defer srv.Close()
+
+	str := story.New().
+		Add(story.NewStep().Expect("hello").Respond("hi").Fail("say hello")).
+		Add(story.NewStep().Expect("bye").Respond("goodbye").Fail("say bye"))
+	p := tg.NewPoller(tg.New(srv.URL, str, nil), 0, nil)
+
+	err := p.Run(ctx)
+	require.NoError(t, err, "want no error on stopping by context")
+	require.ErrorIs(t, ctx.Err(), context.Canceled, "want poller to run until all updates are received")
+
+	stp.mu.Lock()
+	defer stp.mu.Unlock()
+	// The last poll is cut by the context, so the offset is confirmed once more on stop
+	assert.Equal(t, []int{0, 12, 13, 13}, stp.gotOffset, "want offset after the last received update")
+	assert.ElementsMatch(t, []string{"hi", "say hello", "goodbye"}, stp.gotText, "want updates processed by handler")
+	assert.Equal(t, 13, p.Offset())
+}
+
+func TestPollerConfirmsOnStop(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+	srv.AddUpdates(
+		tg.Update{UpdateID: 10, Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "hello"}},
+		tg.Update{UpdateID: 11, Message: tg.Message{Chat: tg.Chat{ID: 2}, Text: "hello"}},
+	)
+
+	str := story.New().Add(story.NewStep().Expect("hello").Respond("hi").Fail("say hello"))
+	p := tg.NewPoller(tg.New("", str, nil, tg.WithClient(tg.NewClient(srv.URL))), time.Minute, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	require.Eventually(t, func() bool { return len(srv.Requests("getUpdates")) == 2 }, 5*time.Second, 10*time.Millisecond, "want poller waiting for more updates")
+	cancel()
+	require.NoError(t, <-done)
+
+	gs := srv.Requests("getUpdates")
+	require.Len(t, gs, 3, "want received updates confirmed on stop")
+	assert.Equal(t, float64(12), gs[2].Params["offset"])
+	assert.Equal(t, float64(0), gs[2].Params["timeout"], "want confirmation not waiting for updates")
+	assert.Len(t, srv.Requests("sendMessage"), 2, "want received updates processed before stop")
+}
+
+func TestPollerChatsInParallel(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+	srv.AddUpdates(
+		tg.Update{UpdateID: 1, Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "talk"}},
+		tg.Update{UpdateID: 2, Message: tg.Message{Chat: tg.Chat{ID: 2}, Text: "talk"}},
+	)
+
+	c := newFakeClock()
+	l := tg.NewLimiter(c, 100, 1)
+	str := story.New().Add(story.NewStep().Expect("talk").Respond("one", "two", "three").Fail("talk?"))
+	th := tg.New("", str, nil, tg.WithClient(tg.NewClient(srv.URL)), tg.WithLimiter(l))
+	p := tg.NewPoller(th, time.Minute, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	sent := func() map[float64]int {
+		n := make(map[float64]int)
+		for _, r := range srv.Requests("sendMessage") {
+			n[r.Params["chat_id"].(float64)]++
+		}
+		return n
+	}
+
+	require.Eventually(t, func() bool { return l.Depth() == 2 }, 5*time.Second, time.Millisecond,
+		"want the second chat waiting for the global limit while the first one waits for its own limit")
+	c.Advance(10 * time.Millisecond)
+	assert.Eventually(t, func() bool { n := sent(); return n[1] == 1 && n[2] == 1 }, 5*time.Second, time.Millisecond,
+		"want a chat waiting for its limit not to stall other chats")
+
+	require.Eventually(t, func() bool {
+		c.Advance(time.Second)
+		n := sent()
+		return n[1] == 3 && n[2] == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+}
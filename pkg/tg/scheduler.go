@@ -0,0 +1,250 @@
+package tg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/asahnoln/mesproc/internal/fsutil"
+	"github.com/asahnoln/mesproc/pkg/story"
+)
+
+// Clock tells the time and runs functions later.
+// Schedulers use it instead of the time package, so tests can use a fake clock.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by Clock, *time.Timer implements it
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// RealClock is a Clock using the real time
+var RealClock Clock = realClock{}
+
+// Scheduler keeps delayed responses of each chat until they are due and sends them in order
+type Scheduler interface {
+	// Start makes the scheduler send due responses with the given function.
+	// Handler calls it once when it is created.
+	Start(send func(id int, r story.Response))
+	// Add schedules the response to be sent to the chat after the duration
+	Add(id int, r story.Response, after time.Duration) error
+	// Skip sends the first delayed response of the chat right away.
+	// It returns false if the chat has nothing pending.
+	Skip(id int) bool
+	// Pending returns delayed responses of the chat which are not sent yet
+	Pending(id int) []story.Response
+	// Cancel stops all delayed responses of the chat and returns how many were cancelled
+	Cancel(id int) int
+}
+
+// delayed is a response waiting to be sent to a chat
+type delayed struct {
+	ChatID   int            `json:"chatId"`
+	Due      time.Time      `json:"due"`
+	Response story.Response `json:"response"`
+
+	timer Timer
+}
+
+// timerScheduler keeps delayed responses of each chat in the order they were scheduled.
+// If path is set, every change is saved to the file.
+type timerScheduler struct {
+	mu     sync.Mutex
+	clock  Clock
+	queues map[int][]*delayed
+	send   func(id int, r story.Response)
+
+	path  string
+	grace time.Duration
+}
+
+// NewMemoryScheduler creates a Scheduler which keeps delayed responses in memory only,
+// so they are lost on restart
+func NewMemoryScheduler(c Clock) Scheduler {
+	return &timerScheduler{
+		clock:  c,
+		queues: make(map[int][]*delayed),
+	}
+}
+
+// NewFileScheduler creates a Scheduler which saves delayed responses to the file at path
+// and loads them back, so they survive restarts.
+// Responses which became due while the bot was down are sent on Start,
+// unless they are overdue for more than grace. Zero grace sends all of them.
+func NewFileScheduler(path string, c Clock, grace time.Duration) (Scheduler, error) {
+	s := &timerScheduler{
+		clock:  c,
+		queues: make(map[int][]*delayed),
+		path:   path,
+		grace:  grace,
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tg: scheduler load: %w", err)
+	}
+
+	var ds []*delayed
+	if err := json.Unmarshal(b, &ds); err != nil {
+		return nil, fmt.Errorf("tg: scheduler load %s: %w", path, err)
+	}
+	for _, d := range ds {
+		s.queues[d.ChatID] = append(s.queues[d.ChatID], d)
+	}
+
+	return s, nil
+}
+
+func (s *timerScheduler) Start(send func(id int, r story.Response)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.send = send
+	now := s.clock.Now()
+	for id, q := range s.queues {
+		kept := q[:0]
+		for _, d := range q {
+			late := now.Sub(d.Due)
+			if s.grace > 0 && late > s.grace {
+				continue
+			}
+			s.startTimer(d, d.Due.Sub(now))
+			kept = append(kept, d)
+		}
+
+		if len(kept) == 0 {
+			delete(s.queues, id)
+		} else {
+			s.queues[id] = kept
+		}
+	}
+
+	// Dropped responses should not be loaded again
+	s.save()
+}
+
+func (s *timerScheduler) Add(id int, r story.Response, after time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := &delayed{ChatID: id, Due: s.clock.Now().Add(after), Response: r}
+	s.startTimer(d, after)
+	s.queues[id] = append(s.queues[id], d)
+
+	return s.save()
+}
+
+// startTimer starts the timer of the delayed response, it is not sent before Start
+func (s *timerScheduler) startTimer(d *delayed, after time.Duration) {
+	if after < 0 {
+		after = 0
+	}
+
+	d.timer = s.clock.AfterFunc(after, func() {
+		if s.remove(d) && s.send != nil {
+			s.send(d.ChatID, d.Response)
+		}
+	})
+}
+
+// remove removes the delayed response from the queue of its chat,
+// returning false if it is not there anymore
+func (s *timerScheduler) remove(d *delayed) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queues[d.ChatID]
+	for i, p := range q {
+		if p == d {
+			s.queues[d.ChatID] = append(q[:i:i], q[i+1:]...)
+			if len(s.queues[d.ChatID]) == 0 {
+				delete(s.queues, d.ChatID)
+			}
+			s.save()
+			return true
+		}
+	}
+	return false
+}
+
+func (s *timerScheduler) Skip(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queues[id]) == 0 {
+		return false
+	}
+
+	s.queues[id][0].timer.Reset(0)
+	return true
+}
+
+func (s *timerScheduler) Pending(id int) []story.Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rs := make([]story.Response, len(s.queues[id]))
+	for i, d := range s.queues[id] {
+		rs[i] = d.Response
+	}
+	return rs
+}
+
+func (s *timerScheduler) Cancel(id int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queues[id]
+	for _, d := range q {
+		d.timer.Stop()
+	}
+	delete(s.queues, id)
+	s.save()
+
+	return len(q)
+}
+
+// save writes all delayed responses to the file, replacing it at once,
+// so a crash while saving does not leave a broken file.
+// It should be called with the lock held.
+func (s *timerScheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	ds := make([]*delayed, 0)
+	for _, q := range s.queues {
+		ds = append(ds, q...)
+	}
+
+	b, err := json.Marshal(ds)
+	if err != nil {
+		return fmt.Errorf("tg: scheduler save: %w", err)
+	}
+
+	if err := fsutil.WriteFileAtomic(s.path, b); err != nil {
+		return fmt.Errorf("tg: scheduler save: %w", err)
+	}
+
+	return nil
+}
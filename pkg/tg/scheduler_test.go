@@ -0,0 +1,231 @@
+package tg_test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/asahnoln/mesproc/pkg/tg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock runs timers only when it is advanced
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c      *fakeClock
+	due    time.Time
+	f      func()
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 9, 1, 19, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) tg.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{c: c, due: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward and runs timers which became due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && !t.due.After(c.now) {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].due.Before(due[j].due)
+	})
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	was := t.active
+	t.due = t.c.now.Add(d)
+	t.active = true
+	return was
+}
+
+type sent struct {
+	id   int
+	text string
+}
+
+type sentLog struct {
+	mu sync.Mutex
+	rs []sent
+}
+
+func (l *sentLog) send(id int, r story.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rs = append(l.rs, sent{id, r.Text()})
+}
+
+func (l *sentLog) got() []sent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]sent(nil), l.rs...)
+}
+
+func lateResponses(texts ...string) []story.Response {
+	stp := story.NewStep().Expect("go").Respond(texts...)
+	return story.New().Add(stp).ResponsesTo(&story.State{}, "go")
+}
+
+func TestMemorySchedulerOrderPerChat(t *testing.T) {
+	c := newFakeClock()
+	l := &sentLog{}
+	s := tg.NewMemoryScheduler(c)
+	s.Start(l.send)
+
+	rs := lateResponses("one", "two", "three")
+	require.NoError(t, s.Add(1, rs[0], time.Minute))
+	require.NoError(t, s.Add(1, rs[1], time.Minute*2))
+	require.NoError(t, s.Add(2, rs[2], time.Minute))
+
+	c.Advance(time.Minute)
+	assert.Equal(t, []sent{{1, "one"}, {2, "three"}}, l.got())
+
+	assert.True(t, s.Skip(1))
+	assert.False(t, s.Skip(2), "want nothing to skip for the chat")
+	c.Advance(0)
+	assert.Equal(t, []sent{{1, "one"}, {2, "three"}, {1, "two"}}, l.got())
+	assert.Empty(t, s.Pending(1))
+}
+
+func TestFileSchedulerSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scheduled.json")
+	c := newFakeClock()
+
+	s, err := tg.NewFileScheduler(path, c, 0)
+	require.NoError(t, err)
+	s.Start((&sentLog{}).send)
+
+	rs := lateResponses("soon", "later", "cancelled")
+	require.NoError(t, s.Add(1, rs[0], time.Minute))
+	require.NoError(t, s.Add(1, rs[1], time.Hour))
+	require.NoError(t, s.Add(2, rs[2], time.Minute))
+	assert.Equal(t, 1, s.Cancel(2))
+
+	// The bot is restarted
+	restarted, err := tg.NewFileScheduler(path, c, 0)
+	require.NoError(t, err)
+	require.Len(t, restarted.Pending(1), 2)
+	assert.Equal(t, "soon", restarted.Pending(1)[0].Text())
+	assert.Equal(t, "later", restarted.Pending(1)[1].Text())
+	assert.Empty(t, restarted.Pending(2), "want cancelled response not restored")
+
+	l := &sentLog{}
+	restarted.Start(l.send)
+	c.Advance(time.Minute)
+	assert.Equal(t, []sent{{1, "soon"}}, l.got())
+
+	c.Advance(time.Hour)
+	assert.Equal(t, []sent{{1, "soon"}, {1, "later"}}, l.got())
+
+	again, err := tg.NewFileScheduler(path, c, 0)
+	require.NoError(t, err)
+	assert.Empty(t, again.Pending(1), "want sent responses removed from the file")
+}
+
+func TestFileSchedulerOverdue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scheduled.json")
+	c := newFakeClock()
+
+	s, err := tg.NewFileScheduler(path, c, 0)
+	require.NoError(t, err)
+	s.Start((&sentLog{}).send)
+
+	rs := lateResponses("long overdue", "just overdue", "not yet")
+	require.NoError(t, s.Add(1, rs[0], time.Minute))
+	require.NoError(t, s.Add(1, rs[1], time.Minute*9))
+	require.NoError(t, s.Add(1, rs[2], time.Minute*20))
+
+	// The bot was down for 15 minutes
+	c = &fakeClock{now: c.Now().Add(time.Minute * 15)}
+	restarted, err := tg.NewFileScheduler(path, c, time.Minute*10)
+	require.NoError(t, err)
+
+	l := &sentLog{}
+	restarted.Start(l.send)
+	c.Advance(0)
+	assert.Equal(t, []sent{{1, "just overdue"}}, l.got(), "want overdue response sent within grace")
+
+	c.Advance(time.Minute * 5)
+	assert.Equal(t, []sent{{1, "just overdue"}, {1, "not yet"}}, l.got())
+}
+
+func TestFileSchedulerWrongFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scheduled.json")
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0644))
+
+	_, err := tg.NewFileScheduler(path, newFakeClock(), 0)
+	assert.Error(t, err)
+}
+
+func TestHandlerWithScheduler(t *testing.T) {
+	stg := &stubTgServer{}
+	close, target := stg.tgServerMockURL()
+	defer close()
+
+	str := story.New().
+		Add(story.NewStep().
+			Expect("want late").
+			Respond("now", "late").
+			Fail("fail").
+			Additional(1, "time", time.Hour))
+
+	c := newFakeClock()
+	th := tg.New(target, str, nil, tg.WithScheduler(tg.NewMemoryScheduler(c)))
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "want late"}})
+	require.Len(t, stg.texts(), 1)
+	require.Len(t, th.PendingResponses(1), 1)
+
+	c.Advance(time.Hour)
+	require.Len(t, stg.texts(), 2)
+	assert.Equal(t, "late", stg.texts()[1])
+	assert.Empty(t, th.PendingResponses(1))
+}
@@ -0,0 +1,252 @@
+// Package tgtest provides a fake Telegram Bot API server for tests of bots.
+package tgtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/tg"
+)
+
+// Request is a call received by Server
+type Request struct {
+	Method      string                 // Method is the called method, like "sendMessage"
+	ContentType string                 // ContentType is the media type of the request without parameters
+	Params      map[string]interface{} // Params are the JSON body or form values of a multipart request
+	Files       map[string]string      // Files are contents of uploaded files by form fields
+}
+
+// Answer is an answer of Server to a call
+type Answer struct {
+	Status int
+	Body   string
+}
+
+// OK answers with the result
+func OK(result interface{}) Answer {
+	b, _ := json.Marshal(map[string]interface{}{"ok": true, "result": result})
+	return Answer{http.StatusOK, string(b)}
+}
+
+// Error answers with the Bot API error
+func Error(code int, description string) Answer {
+	b, _ := json.Marshal(map[string]interface{}{"ok": false, "error_code": code, "description": description})
+	return Answer{code, string(b)}
+}
+
+// TooManyRequests answers with the error telling to wait retryAfter seconds before calling again
+func TooManyRequests(retryAfter int) Answer {
+	b, _ := json.Marshal(map[string]interface{}{
+		"ok":          false,
+		"error_code":  http.StatusTooManyRequests,
+		"description": fmt.Sprintf("Too Many Requests: retry after %d", retryAfter),
+		"parameters":  map[string]int{"retry_after": retryAfter},
+	})
+	return Answer{http.StatusTooManyRequests, string(b)}
+}
+
+// Server is a fake Telegram Bot API. It records calls and answers them like Telegram:
+// sent messages are returned with new IDs, getUpdates returns added updates, other calls return true.
+// Like Telegram, getUpdates with a timeout waits for updates to be added, up to the timeout.
+// Answers can be replaced for any method.
+type Server struct {
+	URL string // URL is the target for tg.Client and tg.Handler
+
+	srv      *httptest.Server
+	mu       sync.Mutex
+	requests []Request
+	answers  map[string][]Answer
+	updates  [][]tg.Update
+	added    chan struct{}
+	messages int
+}
+
+// NewServer starts a Server, it should be closed at the end of the test
+func NewServer() *Server {
+	s := &Server{answers: make(map[string][]Answer), added: make(chan struct{})}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close stops the Server
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Answer makes the Server give the answers to the next calls of the method, one answer per call
+func (s *Server) Answer(method string, as ...Answer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.answers[method] = append(s.answers[method], as...)
+}
+
+// AddUpdates makes the Server return the updates to one getUpdates call
+func (s *Server) AddUpdates(us ...tg.Update) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates = append(s.updates, us)
+	close(s.added)
+	s.added = make(chan struct{})
+}
+
+// Requests returns calls received so far. If methods are given, only calls of them are returned.
+func (s *Server) Requests(methods ...string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rs []Request
+	for _, r := range s.requests {
+		if len(methods) == 0 || contains(methods, r.Method) {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// Methods returns names of methods called so far in order
+func (s *Server) Methods() []string {
+	var ms []string
+	for _, r := range s.Requests() {
+		ms = append(ms, r.Method)
+	}
+	return ms
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	req, err := readRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	added, timeout := s.longPoll(req)
+	s.mu.Unlock()
+
+	if added != nil {
+		select {
+		case <-added:
+		case <-time.After(timeout):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	a := s.answer(req)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(a.Status)
+	io.WriteString(w, a.Body)
+}
+
+// longPoll returns the channel closed when updates are added and how long to wait for them,
+// if the call waits for updates. It should be called with the lock held.
+func (s *Server) longPoll(req Request) (chan struct{}, time.Duration) {
+	timeout, _ := req.Params["timeout"].(float64)
+	if req.Method != "getUpdates" || timeout <= 0 || len(s.updates) > 0 || len(s.answers[req.Method]) > 0 {
+		return nil, 0
+	}
+	return s.added, time.Duration(timeout * float64(time.Second))
+}
+
+// answer returns the given answer for the call or the default one, it should be called with the lock held
+func (s *Server) answer(req Request) Answer {
+	if as := s.answers[req.Method]; len(as) > 0 {
+		s.answers[req.Method] = as[1:]
+		return as[0]
+	}
+
+	switch {
+	case req.Method == "getMe":
+		return OK(tg.User{ID: 1, IsBot: true, FirstName: "Test", Username: "test_bot"})
+	case req.Method == "getUpdates":
+		us := []tg.Update{}
+		if len(s.updates) > 0 {
+			us, s.updates = s.updates[0], s.updates[1:]
+		}
+		return OK(us)
+	case req.Method == "sendMediaGroup":
+		var ms []interface{}
+		media, _ := req.Params["media"].([]interface{})
+		for range media {
+			ms = append(ms, s.message(req))
+		}
+		return OK(ms)
+	case strings.HasPrefix(req.Method, "send") && req.Method != "sendChatAction":
+		return OK(s.message(req))
+	}
+
+	return OK(true)
+}
+
+// message makes a new sent message for the call, it should be called with the lock held
+func (s *Server) message(req Request) map[string]interface{} {
+	s.messages++
+	return map[string]interface{}{
+		"message_id": s.messages,
+		"chat":       map[string]interface{}{"id": req.Params["chat_id"]},
+	}
+}
+
+// readRequest reads params of JSON and multipart requests, form values which are JSON are decoded
+func readRequest(r *http.Request) (Request, error) {
+	req := Request{
+		Method: path.Base(r.URL.Path),
+		Params: make(map[string]interface{}),
+		Files:  make(map[string]string),
+	}
+	req.ContentType, _, _ = mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if req.ContentType != "multipart/form-data" {
+		if err := json.NewDecoder(r.Body).Decode(&req.Params); err != nil && err != io.EOF {
+			return req, fmt.Errorf("tgtest: %s: %w", req.Method, err)
+		}
+		return req, nil
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return req, fmt.Errorf("tgtest: %s: %w", req.Method, err)
+	}
+	for k, vs := range r.MultipartForm.Value {
+		var v interface{}
+		if json.Unmarshal([]byte(vs[0]), &v) != nil {
+			v = vs[0]
+		}
+		req.Params[k] = v
+	}
+	for k, fs := range r.MultipartForm.File {
+		f, err := fs[0].Open()
+		if err != nil {
+			return req, fmt.Errorf("tgtest: %s: %w", req.Method, err)
+		}
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return req, fmt.Errorf("tgtest: %s: %w", req.Method, err)
+		}
+		req.Files[k] = string(b)
+	}
+
+	return req, nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,19 @@
 package tg
 
 // Update is an object sent by Bot when it receives a message from user
+// or when user presses an inline button
 type Update struct {
-	Message Message
+	UpdateID      int            `json:"update_id"`
+	Message       Message        `json:"message"`
+	CallbackQuery *CallbackQuery `json:"callback_query,omitempty"`
+}
+
+// CallbackQuery is a subobject of Update object with info on pressed inline button
+type CallbackQuery struct {
+	ID      string   `json:"id"`
+	From    From     `json:"from"`
+	Message *Message `json:"message,omitempty"`
+	Data    string   `json:"data"`
 }
 
 // Chat is a subobject with chat information
@@ -14,12 +25,14 @@ type From struct {
 	LanguageCode string `json:"language_code"`
 }
 
-// Message is a subobject of Update object with info on received message
+// Message is a subobject of Update object with info on received message.
+// Typed send methods of Client return sent messages as Message too.
 type Message struct {
-	Chat     Chat
-	Text     string
-	Location *Location
-	From     From
+	MessageID int `json:"message_id"`
+	Chat      Chat
+	Text      string
+	Location  *Location
+	From      From
 }
 
 // Location is a subobject of Message object with info on sent geolocation
@@ -27,22 +40,115 @@ type Location struct {
 	Longitude, Latitude float64
 }
 
+// GetUpdates is an object used to receive updates from a bot by long polling
+type GetUpdates struct {
+	Offset         int      `json:"offset,omitempty"`
+	Timeout        int      `json:"timeout"`
+	AllowedUpdates []string `json:"allowed_updates,omitempty"`
+}
+
+// User is a user or a bot, returned by getMe
+type User struct {
+	ID        int    `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	Username  string `json:"username,omitempty"`
+}
+
+// SetWebhook is an object used to make a bot send updates to the webhook
+type SetWebhook struct {
+	URL string `json:"url"`
+	// Certificate is a path to the public key of a self-signed certificate, it is uploaded with the call
+	Certificate        string   `json:"certificate,omitempty"`
+	SecretToken        string   `json:"secret_token,omitempty"`
+	AllowedUpdates     []string `json:"allowed_updates,omitempty"`
+	DropPendingUpdates bool     `json:"drop_pending_updates,omitempty"`
+}
+
+// DeleteWebhook is an object used to stop a bot sending updates to the webhook
+type DeleteWebhook struct {
+	DropPendingUpdates bool `json:"drop_pending_updates,omitempty"`
+}
+
+// BotCommand is a command shown in the menu of a bot, like "start"
+type BotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// SetMyCommands is an object used to set commands of a bot, for users with the language or for all of them
+type SetMyCommands struct {
+	Commands     []BotCommand `json:"commands"`
+	LanguageCode string       `json:"language_code,omitempty"`
+}
+
 // SendMessage is an object used to send a message to a bot
 type SendMessage struct {
-	ChatID int    `json:"chat_id"`
-	Text   string `json:"text"`
+	ChatID      int         `json:"chat_id"`
+	Text        string      `json:"text"`
+	ParseMode   string      `json:"parse_mode,omitempty"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
 }
 
 // SendAudio is an object used to send an audio to a bot
 type SendAudio struct {
-	ChatID int    `json:"chat_id"`
-	Audio  string `json:"audio"`
+	ChatID      int         `json:"chat_id"`
+	Audio       string      `json:"audio"`
+	Caption     string      `json:"caption,omitempty"`
+	ParseMode   string      `json:"parse_mode,omitempty"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
 }
 
 // SendPhoto is an object used to send an audio to a bot
 type SendPhoto struct {
-	ChatID int    `json:"chat_id"`
-	Photo  string `json:"photo"`
+	ChatID      int         `json:"chat_id"`
+	Photo       string      `json:"photo"`
+	Caption     string      `json:"caption,omitempty"`
+	ParseMode   string      `json:"parse_mode,omitempty"`
+	ReplyMarkup interface{} `json:"reply_markup,omitempty"`
+}
+
+// SendMediaGroup is an object used to send several photos, videos, audios or documents
+// to a bot as one album. Albums cannot have keyboards.
+type SendMediaGroup struct {
+	ChatID int          `json:"chat_id"`
+	Media  []InputMedia `json:"media"`
+}
+
+// InputMedia is an item of SendMediaGroup
+type InputMedia struct {
+	Type      string `json:"type"`
+	Media     string `json:"media"`
+	Caption   string `json:"caption,omitempty"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+// ReplyKeyboardMarkup is a keyboard with buttons replacing the keyboard of the user
+type ReplyKeyboardMarkup struct {
+	Keyboard        [][]KeyboardButton `json:"keyboard"`
+	ResizeKeyboard  bool               `json:"resize_keyboard,omitempty"`
+	OneTimeKeyboard bool               `json:"one_time_keyboard,omitempty"`
+}
+
+// KeyboardButton is a button of ReplyKeyboardMarkup, its text is sent when pressed
+type KeyboardButton struct {
+	Text string `json:"text"`
+}
+
+// InlineKeyboardMarkup is a keyboard with buttons attached to the message
+type InlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+// InlineKeyboardButton is a button of InlineKeyboardMarkup, its data comes back in CallbackQuery when pressed
+type InlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+// AnswerCallbackQuery is an object used to tell a bot the pressed inline button is handled
+type AnswerCallbackQuery struct {
+	CallbackQueryID string `json:"callback_query_id"`
 }
 
 // SendChatAction is an object used to send a chat action to a bot
@@ -61,6 +167,31 @@ func (s *SendPhoto) SetContent(a string) {
 	s.Photo = a
 }
 
+// SetCaption sets a caption for current sender
+func (s *SendPhoto) SetCaption(c string) {
+	s.Caption = c
+}
+
+// SetParseMode sets a parse mode for current sender
+func (s *SendPhoto) SetParseMode(m string) {
+	s.ParseMode = m
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendPhoto) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// FileField returns the name of the field with the file
+func (s *SendPhoto) FileField() string {
+	return "photo"
+}
+
+// File returns the file to send
+func (s *SendPhoto) File() string {
+	return s.Photo
+}
+
 // URL returns Telegram endpoint to process current sender
 func (s *SendPhoto) URL() string {
 	return "/sendPhoto"
@@ -84,6 +215,31 @@ func (s *SendAudio) SetContent(a string) {
 	s.Audio = a
 }
 
+// SetCaption sets a caption for current sender
+func (s *SendAudio) SetCaption(c string) {
+	s.Caption = c
+}
+
+// SetParseMode sets a parse mode for current sender
+func (s *SendAudio) SetParseMode(m string) {
+	s.ParseMode = m
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendAudio) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
+// FileField returns the name of the field with the file
+func (s *SendAudio) FileField() string {
+	return "audio"
+}
+
+// File returns the file to send
+func (s *SendAudio) File() string {
+	return s.Audio
+}
+
 // URL returns Telegram endpoint to process current sender
 func (s *SendAudio) URL() string {
 	return "/sendAudio"
@@ -107,7 +263,51 @@ func (s *SendMessage) SetContent(a string) {
 	s.Text = a
 }
 
+// SetParseMode sets a parse mode for current sender
+func (s *SendMessage) SetParseMode(m string) {
+	s.ParseMode = m
+}
+
+// SetReplyMarkup sets a keyboard for current sender
+func (s *SendMessage) SetReplyMarkup(m interface{}) {
+	s.ReplyMarkup = m
+}
+
 // URL returns Telegram endpoint to process current sender
 func (s *SendMessage) URL() string {
 	return "/sendMessage"
 }
+
+// SetChatID sets chat ID for current sender
+func (s *SendMediaGroup) SetChatID(i int) {
+	s.ChatID = i
+}
+
+// SetContent sets the caption of the album, which is shown as the caption of the first item
+// unless it has its own
+func (s *SendMediaGroup) SetContent(a string) {
+	if len(s.Media) > 0 && s.Media[0].Caption == "" {
+		s.Media[0].Caption = a
+	}
+}
+
+// URL returns Telegram endpoint to process current sender
+func (s *SendMediaGroup) URL() string {
+	return "/sendMediaGroup"
+}
+
+func (s *SendMediaGroup) GetChatID() int {
+	return s.ChatID
+}
+
+func (s *SendMediaGroup) ChatAction() string {
+	if len(s.Media) > 0 {
+		switch s.Media[0].Type {
+		case "photo":
+			return "upload_photo"
+		case "video":
+			return "upload_video"
+		}
+	}
+	return "upload_document"
+}
@@ -0,0 +1,440 @@
+package tg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asahnoln/mesproc/internal/fsutil"
+)
+
+// FileSender is a Sender of a file, which can be a URL, a file_id of a file sent before or a path to a local file.
+// Local files are uploaded on first use and their file_id is reused afterwards.
+type FileSender interface {
+	FileField() string // FileField returns the name of the field with the file, like "audio"
+	File() string      // File returns the file to send
+}
+
+// FileCache keeps file_ids Telegram gave to uploaded local files,
+// so they are not uploaded again. Keys are made of the media field and the hash of the file.
+type FileCache interface {
+	Get(key string) (string, bool)
+	Put(key, fileID string) error
+}
+
+// WithFileCache makes the Handler keep file_ids of uploaded local files in the given cache.
+// By default they are kept in memory, so files are uploaded again after restart.
+func WithFileCache(c FileCache) Option {
+	return func(h *Handler) {
+		h.files = c
+	}
+}
+
+// WithMediaDir makes the Handler look for local files of the story relative to the directory.
+// By default they are relative to the working directory.
+func WithMediaDir(dir string) Option {
+	return func(h *Handler) {
+		h.mediaDir = dir
+	}
+}
+
+// fileCache keeps file_ids in memory and saves them to the file at path if it is set
+type fileCache struct {
+	mu   sync.Mutex
+	ids  map[string]string
+	path string
+}
+
+// NewMemoryFileCache creates a FileCache which keeps file_ids in memory only
+func NewMemoryFileCache() FileCache {
+	return &fileCache{ids: make(map[string]string)}
+}
+
+// NewFileCache creates a FileCache which saves file_ids to the JSON file at path and loads them back,
+// so local files are not uploaded again after restart
+func NewFileCache(path string) (FileCache, error) {
+	c := &fileCache{ids: make(map[string]string), path: path}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tg: file cache load: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &c.ids); err != nil {
+		return nil, fmt.Errorf("tg: file cache load %s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+func (c *fileCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.ids[key]
+	return id, ok
+}
+
+func (c *fileCache) Put(key, fileID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ids[key] = fileID
+	if c.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(c.ids)
+	if err != nil {
+		return fmt.Errorf("tg: file cache save: %w", err)
+	}
+
+	// The file is replaced at once, so a crash while saving does not leave a broken file
+	if err := fsutil.WriteFileAtomic(c.path, b); err != nil {
+		return fmt.Errorf("tg: file cache save: %w", err)
+	}
+
+	return nil
+}
+
+// upload is a local file to be sent in a multipart form
+type upload struct {
+	part  string // part is the name of the form part with the file
+	field string // field is the media field in the result with the file_id
+	item  int    // item is the index of the media group item, its message in the result has the file_id
+	path  string
+	key   string
+}
+
+// localFiles remembers hashes of local files, so a file is hashed again only when its size or modification time change,
+// and locks keys of files being uploaded, so a file needed by several chats at once is uploaded once
+type localFiles struct {
+	mu      sync.Mutex
+	hashes  map[string]fileHash
+	uploads map[string]*keyLock
+}
+
+type fileHash struct {
+	size int64
+	mod  time.Time
+	hash string
+}
+
+type keyLock struct {
+	mu      sync.Mutex
+	waiting int
+}
+
+func newLocalFiles() *localFiles {
+	return &localFiles{hashes: make(map[string]fileHash), uploads: make(map[string]*keyLock)}
+}
+
+// hash returns the hash of the file at path
+func (l *localFiles) hash(path string) (string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("tg: local file: %w", err)
+	}
+	if st.IsDir() {
+		return "", fmt.Errorf("tg: local file %s is a directory", path)
+	}
+
+	l.mu.Lock()
+	fh, ok := l.hashes[path]
+	l.mu.Unlock()
+	if ok && fh.size == st.Size() && fh.mod.Equal(st.ModTime()) {
+		return fh.hash, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("tg: local file: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("tg: hash %s: %w", path, err)
+	}
+
+	fh = fileHash{size: st.Size(), mod: st.ModTime(), hash: hex.EncodeToString(hash.Sum(nil))}
+	l.mu.Lock()
+	l.hashes[path] = fh
+	l.mu.Unlock()
+
+	return fh.hash, nil
+}
+
+// lock locks the keys and returns the function unlocking them.
+// Keys are locked in order, so senders sharing several files do not wait for each other forever.
+func (l *localFiles) lock(keys []string) func() {
+	sort.Strings(keys)
+	var locked []string
+	for i, k := range keys {
+		if i > 0 && k == keys[i-1] {
+			continue
+		}
+
+		l.mu.Lock()
+		kl, ok := l.uploads[k]
+		if !ok {
+			kl = &keyLock{}
+			l.uploads[k] = kl
+		}
+		kl.waiting++
+		l.mu.Unlock()
+
+		kl.mu.Lock()
+		locked = append(locked, k)
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		for _, k := range locked {
+			kl := l.uploads[k]
+			kl.mu.Unlock()
+			kl.waiting--
+			if kl.waiting == 0 {
+				delete(l.uploads, k)
+			}
+		}
+	}
+}
+
+// localFile returns the path to the local file and its cache key,
+// or false if the content is a URL or a file_id.
+// A path to a missing or unreadable file is an error.
+func (h *Handler) localFile(content, field string) (string, string, bool, error) {
+	if !isLocalFile(content) {
+		return "", "", false, nil
+	}
+
+	path := content
+	if h.mediaDir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(h.mediaDir, path)
+	}
+	hash, err := h.local.hash(path)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	return path, field + ":" + hash, true, nil
+}
+
+// isLocalFile tells paths to local files from URLs and file_ids, which have neither extensions nor directories
+func isLocalFile(content string) bool {
+	if content == "" || strings.Contains(content, "://") {
+		return false
+	}
+	return filepath.Ext(content) != "" || strings.ContainsAny(content, `/\`)
+}
+
+// pendingKeys returns cache keys of local files of the sender which are not uploaded yet
+func (h *Handler) pendingKeys(v Sender) ([]string, error) {
+	var files [][2]string
+	switch s := v.(type) {
+	case FileSender:
+		files = append(files, [2]string{s.File(), s.FileField()})
+	case *SendMediaGroup:
+		for _, m := range s.Media {
+			files = append(files, [2]string{m.Media, m.Type})
+		}
+	}
+
+	var keys []string
+	for _, f := range files {
+		_, key, ok, err := h.localFile(f[0], f[1])
+		if err != nil {
+			return nil, err
+		}
+		if _, cached := h.files.Get(key); ok && !cached {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// prepareUploads replaces local files of the sender with cached file_ids
+// and returns those which have to be uploaded
+func (h *Handler) prepareUploads(v Sender) ([]upload, error) {
+	var ups []upload
+
+	switch s := v.(type) {
+	case FileSender:
+		path, key, ok, err := h.localFile(s.File(), s.FileField())
+		if err != nil || !ok {
+			return nil, err
+		}
+		if id, ok := h.files.Get(key); ok {
+			v.SetContent(id)
+			return nil, nil
+		}
+		ups = append(ups, upload{part: s.FileField(), field: s.FileField(), path: path, key: key})
+	case *SendMediaGroup:
+		for i, m := range s.Media {
+			path, key, ok, err := h.localFile(m.Media, m.Type)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if id, ok := h.files.Get(key); ok {
+				s.Media[i].Media = id
+				continue
+			}
+
+			part := fmt.Sprintf("file%d", i)
+			s.Media[i].Media = "attach://" + part
+			ups = append(ups, upload{part: part, field: m.Type, item: i, path: path, key: key})
+		}
+	}
+
+	return ups, nil
+}
+
+// postUploads sends the sender with its local files as multipart/form-data
+// and caches file_ids Telegram gives to them
+func (h *Handler) postUploads(v Sender, ups []upload) error {
+	body, contentType, err := multipartBody(v, ups)
+	if err != nil {
+		return err
+	}
+
+	result, err := h.client.post(context.Background(), v.URL(), contentType, body)
+	if err != nil {
+		return err
+	}
+
+	// A media group results in a message for each item, other senders in one message
+	var msgs []map[string]json.RawMessage
+	if _, ok := v.(*SendMediaGroup); ok {
+		err = json.Unmarshal(result, &msgs)
+	} else {
+		msgs = make([]map[string]json.RawMessage, 1)
+		err = json.Unmarshal(result, &msgs[0])
+	}
+	if err != nil {
+		return fmt.Errorf("tg: upload result: %w", err)
+	}
+
+	for _, up := range ups {
+		var id string
+		if up.item < len(msgs) {
+			id = fileID(msgs[up.item][up.field])
+		}
+		if id == "" {
+			return fmt.Errorf("tg: upload %s: no file_id in result", up.path)
+		}
+		if err := h.files.Put(up.key, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fileID returns file_id of a file object in the result.
+// Photos come in several sizes, the largest one is the last.
+func fileID(raw json.RawMessage) string {
+	var f struct {
+		FileID string `json:"file_id"`
+	}
+	if json.Unmarshal(raw, &f) == nil {
+		return f.FileID
+	}
+
+	var sizes []struct {
+		FileID string `json:"file_id"`
+	}
+	if json.Unmarshal(raw, &sizes) == nil && len(sizes) > 0 {
+		return sizes[len(sizes)-1].FileID
+	}
+
+	return ""
+}
+
+// multipartBody writes fields of the object as form values,
+// objects like keyboards are written as JSON, and local files as file parts
+func multipartBody(v interface{}, ups []upload) ([]byte, string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", fmt.Errorf("tg: upload: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, "", fmt.Errorf("tg: upload: %w", err)
+	}
+
+	files := make(map[string]bool)
+	for _, up := range ups {
+		files[up.part] = true
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if !files[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for _, k := range keys {
+		value := string(fields[k])
+		var s string
+		if json.Unmarshal(fields[k], &s) == nil {
+			value = s
+		}
+		if err := w.WriteField(k, value); err != nil {
+			return nil, "", fmt.Errorf("tg: upload: %w", err)
+		}
+	}
+
+	for _, up := range ups {
+		if err := writeFile(w, up); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", fmt.Errorf("tg: upload: %w", err)
+	}
+
+	return body.Bytes(), w.FormDataContentType(), nil
+}
+
+func writeFile(w *multipart.Writer, up upload) error {
+	f, err := os.Open(up.path)
+	if err != nil {
+		return fmt.Errorf("tg: upload: %w", err)
+	}
+	defer f.Close()
+
+	part, err := w.CreateFormFile(up.part, filepath.Base(up.path))
+	if err != nil {
+		return fmt.Errorf("tg: upload: %w", err)
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return fmt.Errorf("tg: upload %s: %w", up.path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,280 @@
+package tg_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/asahnoln/mesproc/pkg/tg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadRequest is a request received by stubUploadServer
+type uploadRequest struct {
+	path   string
+	fields map[string]string // fields are form values of multipart requests or the JSON body
+	files  map[string]string // files are contents of uploaded files by form parts
+}
+
+// stubUploadServer records requests and answers uploads with file_ids like Telegram
+type stubUploadServer struct {
+	mu   sync.Mutex
+	reqs []uploadRequest
+}
+
+func (s *stubUploadServer) start(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := uploadRequest{path: r.URL.Path, fields: map[string]string{}, files: map[string]string{}}
+
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			require.NoError(t, r.ParseMultipartForm(1<<20))
+			for k, vs := range r.MultipartForm.Value {
+				req.fields[k] = vs[0]
+			}
+			for k, fs := range r.MultipartForm.File {
+				f, err := fs[0].Open()
+				require.NoError(t, err)
+				b, _ := io.ReadAll(f)
+				req.files[k] = string(b)
+			}
+		} else {
+			var m map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&m)
+			for k, v := range m {
+				b, _ := json.Marshal(v)
+				req.fields[k] = strings.Trim(string(b), `"`)
+			}
+		}
+
+		s.mu.Lock()
+		s.reqs = append(s.reqs, req)
+		s.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/sendAudio":
+			w.Write([]byte(`{"ok":true,"result":{"audio":{"file_id":"audio-id"}}}`))
+		case "/sendPhoto":
+			w.Write([]byte(`{"ok":true,"result":{"photo":[{"file_id":"small-id"},{"file_id":"photo-id"}]}}`))
+		case "/sendMediaGroup":
+			w.Write([]byte(`{"ok":true,"result":[{"photo":[{"file_id":"album-photo-id"}]},{"video":{"file_id":"album-video-id"}}]}`))
+		default:
+			w.Write([]byte(`{"ok":true,"result":true}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+// sent returns requests received so far, except chat actions
+func (s *stubUploadServer) sent() []uploadRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rs []uploadRequest
+	for _, r := range s.reqs {
+		if r.path != "/sendChatAction" {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+func writeMedia(t *testing.T, dir, name, content string) {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestUploadLocalFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeMedia(t, dir, "media/scene1.mp3", "scene one sound")
+	writeMedia(t, dir, "media/scene1.jpg", "scene one picture")
+
+	str := story.New().Add(story.NewStep().
+		Expect("go").
+		Respond("audio:media/scene1.mp3", "photo:media/scene1.jpg", "audio:http://example.com/remote.mp3"))
+	stg := &stubUploadServer{}
+	th := tg.New(stg.start(t), str, nil, tg.WithMediaDir(dir))
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 6}, Text: "go"}})
+
+	rs := stg.sent()
+	require.Len(t, rs, 3)
+	assert.Equal(t, "/sendAudio", rs[0].path)
+	assert.Equal(t, "6", rs[0].fields["chat_id"])
+	assert.Equal(t, "scene one sound", rs[0].files["audio"], "want local file uploaded")
+	assert.Equal(t, "/sendPhoto", rs[1].path)
+	assert.Equal(t, "scene one picture", rs[1].files["photo"])
+	assert.Equal(t, "http://example.com/remote.mp3", rs[2].fields["audio"], "want URL sent as is")
+	assert.Empty(t, rs[2].files)
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 7}, Text: "go"}})
+
+	rs = stg.sent()[3:]
+	require.Len(t, rs, 3)
+	assert.Empty(t, rs[0].files, "want uploaded file not uploaded again")
+	assert.Equal(t, "audio-id", rs[0].fields["audio"])
+	assert.Equal(t, "7", rs[0].fields["chat_id"])
+	assert.Equal(t, "photo-id", rs[1].fields["photo"], "want the largest photo size reused")
+}
+
+func TestUploadAlbum(t *testing.T) {
+	dir := t.TempDir()
+	writeMedia(t, dir, "one.jpg", "first picture")
+	writeMedia(t, dir, "two.mp4", "second video")
+
+	str := story.New().Add(story.NewStep().
+		Expect("go").
+		Respond("our trip").
+		Media(0, story.Media{Type: story.MediaAlbum, Items: []story.Media{
+			{Type: story.MediaPhoto, URL: "one.jpg"},
+			{Type: story.MediaVideo, URL: "two.mp4"},
+		}}))
+	stg := &stubUploadServer{}
+	th := tg.New(stg.start(t), str, nil, tg.WithMediaDir(dir))
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 6}, Text: "go"}})
+
+	rs := stg.sent()
+	require.Len(t, rs, 1)
+	assert.Equal(t, "first picture", rs[0].files["file0"])
+	assert.Equal(t, "second video", rs[0].files["file1"])
+	assert.JSONEq(t, `[
+		{"type":"photo","media":"attach://file0","caption":"our trip"},
+		{"type":"video","media":"attach://file1"}
+	]`, rs[0].fields["media"])
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 7}, Text: "go"}})
+
+	rs = stg.sent()
+	require.Len(t, rs, 2)
+	assert.Empty(t, rs[1].files)
+	assert.Contains(t, rs[1].fields["media"], "album-photo-id")
+	assert.Contains(t, rs[1].fields["media"], "album-video-id")
+}
+
+func TestFileCacheSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "files.json")
+
+	c, err := tg.NewFileCache(path)
+	require.NoError(t, err)
+	_, ok := c.Get("audio:abc")
+	assert.False(t, ok)
+	require.NoError(t, c.Put("audio:abc", "audio-id"))
+
+	restarted, err := tg.NewFileCache(path)
+	require.NoError(t, err)
+	id, ok := restarted.Get("audio:abc")
+	assert.True(t, ok)
+	assert.Equal(t, "audio-id", id)
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0644))
+	_, err = tg.NewFileCache(path)
+	assert.Error(t, err)
+}
+
+func TestUploadWithFileCache(t *testing.T) {
+	dir := t.TempDir()
+	writeMedia(t, dir, "scene1.mp3", "scene one sound")
+	path := filepath.Join(dir, "files.json")
+
+	str := story.New().Add(story.NewStep().Expect("go").Respond("audio:scene1.mp3"))
+	stg := &stubUploadServer{}
+	target := stg.start(t)
+
+	c, err := tg.NewFileCache(path)
+	require.NoError(t, err)
+	tg.New(target, str, nil, tg.WithMediaDir(dir), tg.WithFileCache(c)).
+		Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 6}, Text: "go"}})
+
+	// The bot is restarted
+	c, err = tg.NewFileCache(path)
+	require.NoError(t, err)
+	tg.New(target, str, nil, tg.WithMediaDir(dir), tg.WithFileCache(c)).
+		Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 6}, Text: "go"}})
+
+	rs := stg.sent()
+	require.Len(t, rs, 2)
+	assert.NotEmpty(t, rs[0].files)
+	assert.Empty(t, rs[1].files, "want file_id reused after restart")
+	assert.Equal(t, "audio-id", rs[1].fields["audio"])
+}
+
+func TestUploadMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	b := &bytes.Buffer{}
+
+	str := story.New().Add(story.NewStep().
+		Expect("go").
+		Respond("audio:scene9.mp3", "sticker:CAACAgIAAxkBAAE"))
+	stg := &stubUploadServer{}
+	th := tg.New(stg.start(t), str, log.New(b, "", 0), tg.WithMediaDir(dir))
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 6}, Text: "go"}})
+
+	rs := stg.sent()
+	require.Len(t, rs, 1, "want the missing file not sent")
+	assert.Equal(t, "/sendSticker", rs[0].path)
+	assert.Equal(t, "CAACAgIAAxkBAAE", rs[0].fields["sticker"], "want file_id sent as is")
+	assert.Contains(t, b.String(), "scene9.mp3", "want the missing file reported")
+}
+
+func TestUploadChangedFile(t *testing.T) {
+	dir := t.TempDir()
+	writeMedia(t, dir, "scene1.mp3", "scene one sound")
+
+	str := story.New().Add(story.NewStep().Expect("go").Respond("audio:scene1.mp3"))
+	stg := &stubUploadServer{}
+	th := tg.New(stg.start(t), str, nil, tg.WithMediaDir(dir))
+
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 6}, Text: "go"}})
+	writeMedia(t, dir, "scene1.mp3", "scene one sound, remastered")
+	th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 6}, Text: "go"}})
+
+	rs := stg.sent()
+	require.Len(t, rs, 2)
+	assert.Equal(t, "scene one sound", rs[0].files["audio"])
+	assert.Equal(t, "scene one sound, remastered", rs[1].files["audio"], "want changed file uploaded again")
+}
+
+func TestUploadOnceForConcurrentChats(t *testing.T) {
+	dir := t.TempDir()
+	writeMedia(t, dir, "scene1.mp3", "scene one sound")
+
+	str := story.New().Add(story.NewStep().Expect("go").Respond("audio:scene1.mp3"))
+	stg := &stubUploadServer{}
+	th := tg.New(stg.start(t), str, nil, tg.WithMediaDir(dir))
+
+	var wg sync.WaitGroup
+	for id := 1; id <= 5; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			th.Process(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: id}, Text: "go"}})
+		}(id)
+	}
+	wg.Wait()
+
+	rs := stg.sent()
+	require.Len(t, rs, 5)
+	uploads := 0
+	for _, r := range rs {
+		if len(r.files) > 0 {
+			uploads++
+		} else {
+			assert.Equal(t, "audio-id", r.fields["audio"])
+		}
+	}
+	assert.Equal(t, 1, uploads, "want the file uploaded once")
+}
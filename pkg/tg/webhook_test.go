@@ -0,0 +1,148 @@
+package tg_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asahnoln/mesproc/pkg/story"
+	"github.com/asahnoln/mesproc/pkg/tg"
+	"github.com/asahnoln/mesproc/pkg/tg/tgtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookRejectsWrongRequests(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+
+	str := story.New().Add(story.NewStep().Expect("go").Respond("moved"))
+	th := tg.New("", str, nil, tg.WithClient(tg.NewClient(srv.URL)))
+	body, _ := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "go"}})
+
+	tests := []struct {
+		name, method, contentType, body string
+		status                          int
+	}{
+		{"get", http.MethodGet, "application/json", string(body), http.StatusMethodNotAllowed},
+		{"form", http.MethodPost, "application/x-www-form-urlencoded", "text=go", http.StatusUnsupportedMediaType},
+		{"no content type", http.MethodPost, "", string(body), http.StatusUnsupportedMediaType},
+		{"malformed", http.MethodPost, "application/json", `{"message":`, http.StatusBadRequest},
+		{"wrong type", http.MethodPost, "application/json", `{"message":{"text":1}}`, http.StatusBadRequest},
+		{"charset", http.MethodPost, "application/json; charset=utf-8", string(body), http.StatusOK},
+		{"too large", http.MethodPost, "application/json", `{"message":{"text":"` + strings.Repeat("a", 2<<20) + `"}}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			th.ServeHTTP(w, r)
+			th.Wait()
+
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusMethodNotAllowed {
+				assert.Equal(t, http.MethodPost, w.Header().Get("Allow"))
+			}
+		})
+	}
+
+	// Without Content-Length the body is cut when it gets too large
+	w := httptest.NewRecorder()
+	r := newUpdateRequest(nil)
+	r.Body = io.NopCloser(io.MultiReader(strings.NewReader(`{"message":{"text":"`), strings.NewReader(strings.Repeat("a", 2<<20))))
+	r.ContentLength = -1
+	th.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	assert.Equal(t, []string{"sendMessage"}, srv.Methods(), "want only the good update processed")
+}
+
+func TestWebhookAcknowledgesBeforeProcessing(t *testing.T) {
+	blocking := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocking
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer srv.Close()
+
+	str := story.New().Add(story.NewStep().Expect("go").Respond("moved"))
+	th := tg.New("", str, nil, tg.WithClient(tg.NewClient(srv.URL)))
+	body, _ := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 1}, Text: "go"}})
+
+	w := httptest.NewRecorder()
+	th.ServeHTTP(w, newUpdateRequest(body))
+	assert.Equal(t, http.StatusOK, w.Code, "want update acknowledged while telegram is slow")
+
+	close(blocking)
+	th.Wait()
+}
+
+func TestWebhookReply(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+
+	str := story.New().
+		Add(story.NewStep().Expect("go").Respond("moved")).
+		Add(story.NewStep().Expect("next").Respond("one", "two")).
+		Add(story.NewStep().Expect("pic").Respond("photo:AgACAgIAAxkBAAI"))
+	th := tg.New("", str, nil, tg.WithClient(tg.NewClient(srv.URL)), tg.WithWebhookReply())
+
+	serve := func(text string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 5}, Text: text}})
+		w := httptest.NewRecorder()
+		th.ServeHTTP(w, newUpdateRequest(body))
+		return w
+	}
+
+	w := serve("go")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"method":"sendMessage","chat_id":5,"text":"moved"}`, w.Body.String(), "want the only response in the reply")
+	assert.Empty(t, srv.Methods(), "want telegram not called for the reply")
+
+	w = serve("next")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, bytes.TrimSpace(w.Body.Bytes()), "want several responses sent in order by calls")
+	assert.Equal(t, []string{"sendMessage", "sendMessage"}, srv.Methods())
+
+	w = serve("pic")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"method":"sendPhoto","chat_id":5,"photo":"AgACAgIAAxkBAAI"}`, w.Body.String(), "want file_id or URL replied")
+}
+
+func TestWebhookReplyWithinLimits(t *testing.T) {
+	srv := tgtest.NewServer()
+	defer srv.Close()
+
+	c := newFakeClock()
+	l := tg.NewLimiter(c, 30, 1)
+	str := story.New().
+		Add(story.NewStep().Expect("go").Respond("moved")).
+		Add(story.NewStep().Expect("next").Respond("moved again"))
+	th := tg.New("", str, nil, tg.WithClient(tg.NewClient(srv.URL)), tg.WithWebhookReply(), tg.WithLimiter(l))
+
+	serve := func(text string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(tg.Update{Message: tg.Message{Chat: tg.Chat{ID: 5}, Text: text}})
+		w := httptest.NewRecorder()
+		th.ServeHTTP(w, newUpdateRequest(body))
+		return w
+	}
+
+	assert.Contains(t, serve("go").Body.String(), "moved")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve("next") }()
+	assert.Eventually(t, func() bool { return l.Depth() == 1 }, time.Second, time.Millisecond, "want the second reply waiting for the limit of the chat")
+
+	c.Advance(time.Second)
+	assert.Contains(t, (<-done).Body.String(), "moved again")
+	assert.Empty(t, srv.Methods())
+}